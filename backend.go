@@ -0,0 +1,183 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// GPIOChip is the interface implemented by GPIO chips.
+// Chip is the implementation for the GPIO character device, the fake package provides an in-memory one for tests
+// and the sysfs package one for the legacy sysfs interface.
+type GPIOChip interface {
+	Name() string
+	Label() string
+	Lines() int
+	LineInfo(offset int) (LineInfo, error)
+	// RequestLines takes a prepared HandleRequest and makes it ready to work by setting its LineDriver.
+	RequestLines(request *HandleRequest) error
+	// RequestEvents requests a line for edge detection, its events being read from the returned EventSource.
+	RequestEvents(request EventRequest) (EventSource, error)
+	Close() error
+}
+
+// LineHandle is the interface implemented by HandleRequest once its lines have been requested.
+type LineHandle interface {
+	Read() (int, []int, error)
+	Write(value0 int, valueN ...int) error
+	Reconfigure(flags HandleRequestFlag, defaults []int) error
+	Close() error
+}
+
+// Watcher is the interface implemented by LineWatcher and PollingWatcher.
+type Watcher interface {
+	Add(chip GPIOChip, line int, flags EventRequestFlags, consumer string, options ...WatchOption) error
+	Remove(chip GPIOChip, line int) error
+	Watched() []WatchedLine
+	Wait() (Event, error)
+	WaitContext(ctx context.Context) (Event, error)
+	WaitForEver(handler EventHandlerFunc) error
+	RunContext(ctx context.Context, handler EventHandlerFunc) error
+	Events(ctx context.Context, options ...EventsOption) <-chan Event
+	Stop() error
+	Close() error
+}
+
+// LineDriver performs the operations on the lines of a HandleRequest granted by a GPIOChip.
+// Values are bitmaps where the bit i is the value of the i-th line of the request,
+// only lines whose bit is set in mask are concerned.
+type LineDriver interface {
+	GetValues(mask uint64) (uint64, error)
+	SetValues(bits, mask uint64) error
+	Reconfigure(flags HandleRequestFlag, defaults []int) error
+	Close() error
+}
+
+// EventRequest describes a line requested for edge detection.
+// Implementations without debouncing support can filter the bounces with a Debouncer.
+type EventRequest struct {
+	Offset   int
+	Flags    EventRequestFlags
+	Consumer string
+	Debounce time.Duration
+	Clock    EventClock
+}
+
+// EventSource delivers the events of a line requested for edge detection to a LineWatcher.
+type EventSource interface {
+	// Fd returns a nonblocking file descriptor which becomes readable when events are available.
+	Fd() int
+	// ReadEvents returns the events available, only Timestamp, ID and LineSeqno have to be set.
+	// The returned slice may be reused by the next call.
+	ReadEvents() ([]Event, error)
+	// Close releases the line.
+	Close() error
+}
+
+// PollEventSource is implemented by the EventSource whose file descriptor signals the available events
+// otherwise than by becoming readable, like the value files of sysfs, which are always readable and report edges
+// as priority data. The file descriptor of other sources is watched for EPOLLIN.
+type PollEventSource interface {
+	EventSource
+	// PollEvents returns the epoll events, such as unix.EPOLLPRI, signaled on Fd when events are available.
+	PollEvents() uint32
+}
+
+// pollEvents returns the epoll events signaling the available events of src.
+func pollEvents(src EventSource) uint32 {
+	if ps, ok := src.(PollEventSource); ok {
+		return ps.PollEvents()
+	}
+	return unix.EPOLLIN
+}
+
+// ClockedChip is implemented by the GPIOChip timestamping the events of its lines with a clock of its own,
+// like the fake chips driven by tests. The PollingWatcher timestamps the samples of their lines with it.
+type ClockedChip interface {
+	GPIOChip
+	// Now returns the current time in nanoseconds of the clock used for the events timestamped with clock.
+	Now(clock EventClock) uint64
+}
+
+// Event IDs, for EventSource implementations.
+const (
+	RisingEdgeEvent  uint32 = eventRisingEdge
+	FallingEdgeEvent uint32 = eventFallingEdge
+)
+
+// Offsets returns the offsets of the lines of the HandleRequest.
+func (hr *HandleRequest) Offsets() []int {
+	offsets := make([]int, hr.lines)
+	for i := range offsets {
+		offsets[i] = int(hr.lineOffsets[i])
+	}
+	return offsets
+}
+
+// Flags returns the flags of the HandleRequest.
+func (hr *HandleRequest) Flags() HandleRequestFlag {
+	return hr.flags
+}
+
+// Consumer returns the consumer of the HandleRequest.
+func (hr *HandleRequest) Consumer() string {
+	return bytesToString(hr.consumer)
+}
+
+// Defaults returns the default values of the lines of the HandleRequest.
+func (hr *HandleRequest) Defaults() []int {
+	defaults := make([]int, hr.lines)
+	for i := range defaults {
+		defaults[i] = int(hr.defaultValues[i])
+	}
+	return defaults
+}
+
+// Debounce returns the debounce period of the HandleRequest.
+func (hr *HandleRequest) Debounce() time.Duration {
+	return hr.debounce
+}
+
+// Err returns the error found while preparing the HandleRequest, if any.
+// GPIOChip implementations must return it from RequestLines.
+func (hr *HandleRequest) Err() error {
+	return hr.err
+}
+
+// SetDriver is called by GPIOChip implementations to make a HandleRequest ready to work,
+// chip being the name of the chip granting the lines.
+func (hr *HandleRequest) SetDriver(chip string, driver LineDriver) {
+	hr.chip = chip
+	hr.driver = driver
+}
+
+// NewLineInfo returns a LineInfo, for GPIOChip implementations.
+// Flags describe the configuration of the line, used tells if the line is in use.
+func NewLineInfo(offset int, name string, consumer string, used bool, flags HandleRequestFlag) LineInfo {
+	li := LineInfo{
+		offset:   uint32(offset),
+		flags:    uint32(flags &^ HandleRequestInput), // other HandleRequest flags match the LineInfo ones
+		name:     stringToBytes(name),
+		consumer: stringToBytes(consumer),
+	}
+	if used {
+		li.flags |= lineFlagKernel
+	}
+	return li
+}
+
+var (
+	_ GPIOChip    = Chip{}
+	_ LineHandle  = (*HandleRequest)(nil)
+	_ EventSource = (*HandleRequest)(nil)
+	_ Watcher     = (*LineWatcher)(nil)
+	_ Watcher     = (*PollingWatcher)(nil)
+	_ LineDriver  = (*cdevLines)(nil)
+	_ EventSource = (*cdevEventSource)(nil)
+)
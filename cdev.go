@@ -0,0 +1,299 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/vinymeuh/chardevgpio/internal/fdfile"
+)
+
+// cdevLines is the LineDriver of lines requested on a Chip through the character device.
+type cdevLines struct {
+	f        *fdfile.File
+	v2       bool // true if lines have been requested using the v2 API
+	lines    uint32
+	debounce time.Duration
+	clock    EventClock
+	values   uint64 // last values set, the v1 API having no mask lines not set keep them
+	events   eventReader
+
+	// buffers reused by each ioctl, so that getting and setting values does not allocate
+	lv   lineValuesV2
+	data handleData
+}
+
+// newCdevLines returns the LineDriver for the lines of a request granted by the kernel.
+func newCdevLines(fd int, v2 bool, hr *handleRequest, debounce time.Duration, clock EventClock) (*cdevLines, error) {
+	if v2 {
+		// edge events are read as those of an EventSource
+		unix.SetNonblock(fd, true)
+	}
+	f, err := fdfile.New(fd, "gpio-lines")
+	if err != nil {
+		return nil, err
+	}
+	cl := &cdevLines{f: f, v2: v2, lines: hr.lines, debounce: debounce, clock: clock, values: defaultValuesBits(hr)}
+	if v2 {
+		cl.events = newEventReader(f, true, clock)
+	}
+	return cl, nil
+}
+
+// defaultValuesBits returns the default values of the request as a bitmap.
+func defaultValuesBits(hr *handleRequest) uint64 {
+	var bits uint64
+	for i := uint32(0); i < hr.lines; i++ {
+		if hr.defaultValues[i] != 0 {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+// GetValues implements LineDriver.
+func (cl *cdevLines) GetValues(mask uint64) (uint64, error) {
+	if cl.v2 {
+		cl.lv = lineValuesV2{mask: mask}
+		if err := cl.f.Ioctl(ioctlLineGetValuesV2, unsafe.Pointer(&cl.lv)); err != nil {
+			return 0, err
+		}
+		return cl.lv.bits & mask, nil
+	}
+
+	cl.data = handleData{}
+	if err := cl.f.Ioctl(ioctlHandleGetLineValues, unsafe.Pointer(&cl.data)); err != nil {
+		return 0, err
+	}
+	var bits uint64
+	for i := uint32(0); i < cl.lines; i++ {
+		if cl.data.values[i] != 0 {
+			bits |= 1 << i
+		}
+	}
+	return bits & mask, nil
+}
+
+// SetValues implements LineDriver.
+func (cl *cdevLines) SetValues(bits, mask uint64) error {
+	if cl.v2 {
+		cl.lv = lineValuesV2{bits: bits, mask: mask}
+		if err := cl.f.Ioctl(ioctlLineSetValuesV2, unsafe.Pointer(&cl.lv)); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	values := cl.values&^mask | bits&mask
+	cl.data = handleData{}
+	for i := uint32(0); i < cl.lines; i++ {
+		cl.data.values[i] = uint8(values >> i & 1)
+	}
+	if err := cl.f.Ioctl(ioctlHandleSetLineValues, unsafe.Pointer(&cl.data)); err != nil {
+		return err
+	}
+	cl.values = values
+	return nil
+}
+
+// Reconfigure implements LineDriver.
+func (cl *cdevLines) Reconfigure(flags HandleRequestFlag, defaults []int) error {
+	next := handleRequest{flags: flags, lines: cl.lines}
+	for i := range defaults {
+		next.defaultValues[i] = uint8(defaults[i])
+	}
+
+	if cl.v2 {
+		lc, err := configV2(uniformLineConfigs(cl.lines, flags, cl.debounce), defaultValuesBits(&next), cl.clock)
+		if err != nil {
+			return err
+		}
+		if err := cl.f.Ioctl(ioctlLineSetConfigV2, unsafe.Pointer(&lc)); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	hc := HandleConfig{
+		flags:         uint32(next.flags),
+		defaultValues: next.defaultValues,
+	}
+	if err := cl.f.Ioctl(ioctlHandleSetConfig, unsafe.Pointer(&hc)); err != nil {
+		return unsupportedBefore(err, 5, 5)
+	}
+	if flags&HandleRequestOutput == HandleRequestOutput {
+		cl.values = defaultValuesBits(&next)
+	}
+	return nil
+}
+
+// Fd implements EventSource, for the lines configured for edge detection.
+func (cl *cdevLines) Fd() int {
+	return cl.f.Fd()
+}
+
+// ReadEvents implements EventSource, for the lines configured for edge detection.
+func (cl *cdevLines) ReadEvents() ([]Event, error) {
+	if !cl.v2 {
+		return nil, ErrUnsupportedByKernel
+	}
+	return cl.events.read()
+}
+
+// Close implements LineDriver.
+func (cl *cdevLines) Close() error {
+	return cl.f.Close()
+}
+
+// cdevEventSource is the EventSource of a line requested on a Chip through the character device.
+type cdevEventSource struct {
+	f         *fdfile.File
+	v2        bool // true if requested using the v2 API
+	events    eventReader
+	debouncer *Debouncer // software debouncer, when debouncing is not supported by the kernel
+	fd        int        // file descriptor returned by Fd
+	lineSeqno uint32     // sequence number of the last event, maintained here with the v1 API
+	evds      []Event    // events returned when debouncing, reused by each read
+}
+
+// newCdevEventSource returns the EventSource for an event line granted by the kernel.
+func newCdevEventSource(fd int, v2 bool, clock EventClock) (*cdevEventSource, error) {
+	// an application that employs the EPOLLET flag should use nonblocking file descriptors (man epoll)
+	unix.SetNonblock(fd, true)
+	f, err := fdfile.New(fd, "gpio-event")
+	if err != nil {
+		return nil, err
+	}
+	return &cdevEventSource{f: f, v2: v2, events: newEventReader(f, v2, clock), fd: f.Fd()}, nil
+}
+
+// debounce makes the EventSource filter the bounces in software, for a line at level requested for both edges,
+// only the edges in flags being returned.
+func (es *cdevEventSource) debounce(flags EventRequestFlags, debounce time.Duration, level int) error {
+	es.debouncer = NewDebouncer(flags, debounce, level)
+	fd, err := es.debouncer.Watch(es.f.Fd(), unix.EPOLLIN)
+	if err != nil {
+		return err
+	}
+	es.fd = fd
+	es.evds = make([]Event, 0, eventsBatch+1)
+	return nil
+}
+
+// Fd implements EventSource.
+func (es *cdevEventSource) Fd() int {
+	return es.fd
+}
+
+// ReadEvents implements EventSource, bounces being dropped.
+func (es *cdevEventSource) ReadEvents() ([]Event, error) {
+	evds, err := es.events.read()
+	if es.v2 {
+		return evds, err
+	}
+	if es.debouncer == nil {
+		for i := range evds {
+			es.lineSeqno++
+			evds[i].LineSeqno = es.lineSeqno
+		}
+		return evds, err
+	}
+
+	es.evds = es.evds[:0]
+	for _, edge := range evds {
+		level := 0
+		if edge.IsRising() {
+			level = 1
+		}
+		es.accept(es.debouncer.Edge(level, edge.Timestamp))
+	}
+	es.accept(es.debouncer.Settle(uint64(monotonicNow())))
+	return es.evds, err
+}
+
+// accept appends an event returned by the debouncer to the events read.
+func (es *cdevEventSource) accept(evd Event, ok bool) {
+	if !ok {
+		return
+	}
+	es.lineSeqno++
+	evd.LineSeqno = es.lineSeqno
+	evd.Clock = ClockMonotonic
+	es.evds = append(es.evds, evd)
+}
+
+// Close implements EventSource.
+func (es *cdevEventSource) Close() error {
+	if es.debouncer != nil {
+		es.debouncer.Close()
+	}
+	return es.f.Close()
+}
+
+// eventsBatch is the number of records read at once from a line request or an event line,
+// the size of the kernel FIFO of an event line.
+const eventsBatch = 16
+
+// eventReader reads the edge events of a line request or of an event line.
+// Records are read in batches and decoded in place, buffers being reused so that reading does not allocate.
+type eventReader struct {
+	f     *fdfile.File
+	v2    bool       // true if the records are lineEventV2, eventData otherwise
+	clock EventClock // clock of the timestamps
+	buf   []byte
+	evds  []Event
+}
+
+func newEventReader(f *fdfile.File, v2 bool, clock EventClock) eventReader {
+	size := eventDataSize
+	if v2 {
+		size = int(unsafe.Sizeof(lineEventV2{}))
+	}
+	return eventReader{
+		f:     f,
+		v2:    v2,
+		clock: clock,
+		buf:   make([]byte, eventsBatch*size),
+		evds:  make([]Event, 0, eventsBatch),
+	}
+}
+
+// read retrieves all events available, without waiting.
+// The returned slice is reused by the next call.
+func (er *eventReader) read() ([]Event, error) {
+	size := eventDataSize
+	if er.v2 {
+		size = int(unsafe.Sizeof(lineEventV2{}))
+	}
+
+	er.evds = er.evds[:0]
+	for {
+		n, err := er.f.Read(er.buf)
+		if err != nil {
+			if err == unix.EAGAIN {
+				return er.evds, nil
+			}
+			return er.evds, err
+		}
+
+		for off := 0; off+size <= n; off += size {
+			if er.v2 {
+				r := (*lineEventV2)(unsafe.Pointer(&er.buf[off]))
+				er.evds = append(er.evds, Event{Timestamp: r.Timestamp, ID: r.ID, Offset: int(r.Offset), LineSeqno: r.LineSeqno, Clock: er.clock})
+				continue
+			}
+			r := (*eventData)(unsafe.Pointer(&er.buf[off]))
+			er.evds = append(er.evds, Event{Timestamp: r.Timestamp, ID: r.ID, Clock: er.clock})
+		}
+		if n < len(er.buf) {
+			// the FIFO has been drained, events arriving later make the file descriptor readable again
+			return er.evds, nil
+		}
+	}
+}
@@ -0,0 +1,355 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// eventPipe is a pipe fed with event records, its read end standing for an event line.
+type eventPipe struct {
+	r, w int
+	v2   bool
+	buf  []byte // records written, reused so that writing does not allocate
+}
+
+func newEventPipe(t testing.TB, v2 bool) *eventPipe {
+	var fds [2]int
+	require.NoError(t, unix.Pipe2(fds[:], unix.O_CLOEXEC))
+	p := &eventPipe{r: fds[0], w: fds[1], v2: v2, buf: make([]byte, 0, 4*eventsBatch*int(unsafe.Sizeof(lineEventV2{})))}
+	t.Cleanup(func() { unix.Close(p.w) })
+	return p
+}
+
+// write writes n records, the i-th one having i+1 as timestamp and sequence numbers.
+func (p *eventPipe) write(t testing.TB, n int) {
+	p.buf = p.buf[:0]
+	for i := 0; i < n; i++ {
+		var rec [unsafe.Sizeof(lineEventV2{})]byte
+		if p.v2 {
+			*(*lineEventV2)(unsafe.Pointer(&rec)) = lineEventV2{Timestamp: uint64(i + 1), ID: eventRisingEdge, Offset: 3, Seqno: uint32(i + 1), LineSeqno: uint32(i + 1)}
+			p.buf = append(p.buf, rec[:]...)
+			continue
+		}
+		*(*eventData)(unsafe.Pointer(&rec)) = eventData{Timestamp: uint64(i + 1), ID: eventFallingEdge}
+		p.buf = append(p.buf, rec[:eventDataSize]...)
+	}
+	if _, err := unix.Write(p.w, p.buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeEdges writes v1 records for edges at the given timestamps, alternately rising and falling
+// from the edge first.
+func (p *eventPipe) writeEdges(t testing.TB, first uint32, timestamps ...int64) {
+	p.buf = p.buf[:0]
+	id := first
+	for _, timestamp := range timestamps {
+		var rec [eventDataSize]byte
+		*(*eventData)(unsafe.Pointer(&rec)) = eventData{Timestamp: uint64(timestamp), ID: id}
+		p.buf = append(p.buf, rec[:]...)
+		id ^= eventRisingEdge | eventFallingEdge
+	}
+	if _, err := unix.Write(p.w, p.buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pipeChip is a GPIOChip whose event lines are pipes, watched for events if not 0.
+// Reading the lines in errs fails with their error once the records are read.
+type pipeChip struct {
+	pipes  map[int]*eventPipe
+	events uint32
+	errs   map[int]error
+}
+
+// pollSource is an EventSource whose file descriptor is watched for other events than EPOLLIN.
+type pollSource struct {
+	*cdevEventSource
+	events uint32
+}
+
+func (ps pollSource) PollEvents() uint32 { return ps.events }
+
+// failingSource is an EventSource whose reads fail.
+type failingSource struct {
+	*cdevEventSource
+	err error
+}
+
+func (fs failingSource) ReadEvents() ([]Event, error) {
+	evds, _ := fs.cdevEventSource.ReadEvents()
+	return evds, fs.err
+}
+
+func (c *pipeChip) Name() string                              { return "pipechip" }
+func (c *pipeChip) Label() string                             { return "pipes" }
+func (c *pipeChip) Lines() int                                { return 8 }
+func (c *pipeChip) LineInfo(offset int) (LineInfo, error)     { return LineInfo{}, nil }
+func (c *pipeChip) RequestLines(request *HandleRequest) error { return ErrUnsupportedByKernel }
+func (c *pipeChip) Close() error                              { return nil }
+
+func (c *pipeChip) RequestEvents(request EventRequest) (EventSource, error) {
+	p := c.pipes[request.Offset]
+	es, err := newCdevEventSource(p.r, p.v2, request.Clock)
+	if err == nil && !p.v2 && request.Debounce > 0 {
+		err = es.debounce(request.Flags, request.Debounce, 0)
+	}
+	if err == nil && c.events != 0 {
+		return pollSource{es, c.events}, nil
+	}
+	if err == nil && c.errs[request.Offset] != nil {
+		return failingSource{es, c.errs[request.Offset]}, nil
+	}
+	return es, err
+}
+
+func TestEventReaderBatch(t *testing.T) {
+	for _, v2 := range []bool{false, true} {
+		p := newEventPipe(t, v2)
+		es, err := newCdevEventSource(p.r, v2, ClockRealtime)
+		require.NoError(t, err)
+
+		// more records than a batch, so that several reads are needed
+		p.write(t, 2*eventsBatch+3)
+		evds, err := es.ReadEvents()
+		assert.NoError(t, err)
+		require.Len(t, evds, 2*eventsBatch+3, "v2 %t", v2)
+		for i, evd := range evds {
+			assert.Equal(t, uint64(i+1), evd.Timestamp)
+			assert.Equal(t, uint32(i+1), evd.LineSeqno)
+			assert.Equal(t, ClockRealtime, evd.Clock)
+			if v2 {
+				assert.True(t, evd.IsRising())
+				assert.Equal(t, 3, evd.Offset)
+			} else {
+				assert.True(t, evd.IsFalling())
+			}
+		}
+
+		evds, err = es.ReadEvents()
+		assert.NoError(t, err)
+		assert.Len(t, evds, 0)
+
+		allocs := testing.AllocsPerRun(100, func() {
+			p.write(t, eventsBatch)
+			es.ReadEvents()
+		})
+		assert.Equal(t, float64(0), allocs, "v2 %t", v2)
+		assert.NoError(t, es.Close())
+	}
+}
+
+func TestEventLineSoftwareDebounce(t *testing.T) {
+	const debounce = 20 * time.Millisecond
+	p := newEventPipe(t, false)
+	lw, err := NewLineWatcher()
+	require.NoError(t, err)
+	defer lw.Close()
+	require.NoError(t, lw.Add(&pipeChip{pipes: map[int]*eventPipe{3: p}}, 3, BothEdges, "button", WithDebounce(debounce)))
+
+	wait := func(timeout time.Duration) (Event, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return lw.WaitContext(ctx)
+	}
+
+	// the line bounces and ends high: the rising edge is reported once it has been stable for the period
+	now := monotonicNow()
+	p.writeEdges(t, eventRisingEdge, now, now+int64(time.Millisecond), now+int64(2*time.Millisecond))
+	evd, err := wait(time.Second)
+	require.NoError(t, err)
+	assert.True(t, evd.IsRising())
+	assert.Equal(t, uint64(now+int64(2*time.Millisecond)+int64(debounce)), evd.Timestamp, "end of the period")
+	assert.Equal(t, uint32(1), evd.LineSeqno)
+	assert.True(t, monotonicNow()-now >= int64(debounce), "reported before the line is stable")
+
+	// a glitch going back to the level reported is dropped
+	now = monotonicNow()
+	p.writeEdges(t, eventFallingEdge, now, now+int64(time.Millisecond))
+	_, err = wait(3 * debounce)
+	assert.Equal(t, context.DeadlineExceeded, err, "glitch not dropped")
+
+	// the line bounces and ends low
+	now = monotonicNow()
+	p.writeEdges(t, eventFallingEdge, now, now+int64(time.Millisecond), now+int64(2*time.Millisecond))
+	evd, err = wait(time.Second)
+	require.NoError(t, err)
+	assert.True(t, evd.IsFalling())
+	assert.Equal(t, uint32(2), evd.LineSeqno)
+
+	// edges read late, each one having been stable for the period, are all reported
+	now = monotonicNow()
+	p.writeEdges(t, eventRisingEdge, now-int64(10*debounce), now-int64(5*debounce))
+	for _, rising := range []bool{true, false} {
+		evd, err = wait(10 * time.Millisecond)
+		require.NoError(t, err)
+		assert.Equal(t, rising, evd.IsRising())
+	}
+	assert.Equal(t, uint64(now-int64(4*debounce)), evd.Timestamp)
+}
+
+func TestLineWatcherPollEvents(t *testing.T) {
+	p := newEventPipe(t, true)
+	lw, err := NewLineWatcher()
+	require.NoError(t, err)
+	defer lw.Close()
+	require.NoError(t, lw.Add(&pipeChip{pipes: map[int]*eventPipe{3: p}, events: unix.EPOLLPRI}, 3, BothEdges, "pipe"))
+
+	// the pipe is readable but never signals priority data
+	p.write(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = lw.WaitContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "source watched for EPOLLIN")
+}
+
+func TestLineWatcherReadError(t *testing.T) {
+	removed, p := newEventPipe(t, true), newEventPipe(t, true)
+	lw, err := NewLineWatcher()
+	require.NoError(t, err)
+	defer lw.Close()
+	chip := &pipeChip{pipes: map[int]*eventPipe{3: removed, 4: p}, errs: map[int]error{3: unix.ENODEV}}
+	require.NoError(t, lw.Add(chip, 3, BothEdges, "removed"))
+	require.NoError(t, lw.Add(chip, 4, BothEdges, "pipe"))
+
+	// both lines are ready, the failing one first
+	removed.write(t, 1)
+	p.write(t, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = lw.WaitContext(ctx)
+	assert.True(t, errors.Is(err, ErrChipRemoved))
+
+	// the events of the other line have been read as well
+	for _, offset := range []int{3, 4} {
+		evd, err := lw.WaitContext(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, offset, evd.Offset)
+	}
+}
+
+func TestLineWatcherAllocs(t *testing.T) {
+	p := newEventPipe(t, true)
+	lw, err := NewLineWatcher()
+	require.NoError(t, err)
+	defer lw.Close()
+	require.NoError(t, lw.Add(&pipeChip{pipes: map[int]*eventPipe{3: p}}, 3, BothEdges, "pipe"))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		p.write(t, eventsBatch)
+		for i := 0; i < eventsBatch; i++ {
+			lw.Wait()
+		}
+	})
+	assert.Equal(t, float64(0), allocs)
+}
+
+// readEventsBinary reads and decodes records one at a time with encoding/binary,
+// as a reference for BenchmarkReadEvents.
+func readEventsBinary(fd int) []Event {
+	var evds []Event
+	for {
+		buffer := make([]byte, unsafe.Sizeof(lineEventV2{}))
+		if _, err := unix.Read(fd, buffer); err != nil {
+			return evds
+		}
+		var r lineEventV2
+		binary.Read(bytes.NewReader(buffer), binary.LittleEndian, &r)
+		evds = append(evds, Event{Timestamp: r.Timestamp, ID: r.ID, Offset: int(r.Offset), LineSeqno: r.LineSeqno})
+	}
+}
+
+func BenchmarkReadEvents(b *testing.B) {
+	b.Run("binary", func(b *testing.B) {
+		p := newEventPipe(b, true)
+		unix.SetNonblock(p.r, true)
+		defer unix.Close(p.r)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			p.write(b, eventsBatch)
+			readEventsBinary(p.r)
+		}
+	})
+
+	for _, v2 := range []bool{false, true} {
+		name := "v1"
+		if v2 {
+			name = "v2"
+		}
+		b.Run(name, func(b *testing.B) {
+			p := newEventPipe(b, v2)
+			es, err := newCdevEventSource(p.r, v2, ClockMonotonic)
+			require.NoError(b, err)
+			defer es.Close()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				p.write(b, eventsBatch)
+				es.ReadEvents()
+			}
+		})
+	}
+}
+
+func BenchmarkLineWatcher(b *testing.B) {
+	p := newEventPipe(b, true)
+	lw, err := NewLineWatcher()
+	require.NoError(b, err)
+	defer lw.Close()
+	require.NoError(b, lw.Add(&pipeChip{pipes: map[int]*eventPipe{3: p}}, 3, BothEdges, "pipe"))
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		p.write(b, eventsBatch)
+		for j := 0; j < eventsBatch; j++ {
+			lw.Wait()
+		}
+	}
+}
+
+func TestUnsupportedBefore(t *testing.T) {
+	kernelAtLeast(0, 0)
+	saved := kernelVersion
+	defer func() { kernelVersion = saved }()
+
+	kernelVersion = [2]int{5, 4}
+	assert.Equal(t, ErrUnsupportedByKernel, unsupportedBefore(unix.EINVAL, 5, 5), "unknown ioctl")
+	assert.Equal(t, unix.EBUSY, unsupportedBefore(unix.EBUSY, 5, 5))
+
+	// once the operation has been introduced, EINVAL is a genuine one
+	kernelVersion = [2]int{5, 10}
+	assert.Equal(t, unix.EINVAL, unsupportedBefore(unix.EINVAL, 5, 5))
+	assert.Equal(t, ErrUnsupportedByKernel, unsupportedBefore(unix.EINVAL, 5, 11))
+}
+
+func TestEventClockUnsupported(t *testing.T) {
+	kernelAtLeast(0, 0)
+	saved := kernelVersion
+	defer func() { kernelVersion = saved }()
+
+	kernelVersion = [2]int{5, 10}
+	assert.Equal(t, ErrUnsupportedByKernel, ClockRealtime.unsupported(unix.EINVAL))
+	assert.Equal(t, ErrUnsupportedByKernel, ClockHTE.unsupported(unix.EINVAL))
+	assert.Equal(t, unix.EINVAL, ClockMonotonic.unsupported(unix.EINVAL))
+
+	kernelVersion = [2]int{5, 15}
+	assert.Equal(t, unix.EINVAL, ClockRealtime.unsupported(unix.EINVAL))
+	assert.Equal(t, ErrUnsupportedByKernel, ClockHTE.unsupported(unix.EINVAL))
+
+	kernelVersion = [2]int{6, 1}
+	assert.Equal(t, unix.EINVAL, ClockHTE.unsupported(unix.EINVAL))
+	assert.Equal(t, unix.EBUSY, ClockHTE.unsupported(unix.EBUSY))
+}
@@ -4,38 +4,57 @@
 // +build linux
 
 // Package chardevgpio is a library to the Linux GPIO Character device API.
+//
+// The v2 API (Linux 5.10 or later) is used when supported by the kernel,
+// otherwise the library falls back to the v1 API.
 package chardevgpio
 
 import (
 	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"os"
-	"syscall"
+	"sort"
+	"sync"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
+
+	"github.com/vinymeuh/chardevgpio/internal/fdfile"
 )
 
 // Chip is a GPIO chip controlling a set of lines.
+// Copies of a Chip share its file descriptor, closing one of them closes them all.
 type Chip struct {
 	ChipInfo
-	fd uintptr
+	f  *fdfile.File
+	v2 bool // true if the kernel supports the v2 API
 }
 
 // NewChip returns a Chip for a GPIO character device from its path.
 func NewChip(path string) (Chip, error) {
-	f, err := os.Open(path)
+	f, err := fdfile.Open(path, os.O_RDONLY)
 	if err != nil {
-		return Chip{}, err
+		var pe *os.PathError
+		if errors.As(err, &pe) {
+			err = pe.Err // OpError already reports the operation and the path
+		}
+		return Chip{}, &OpError{Op: opOpen, Chip: path, Err: err}
+	}
+
+	c := Chip{f: f}
+	if err := c.f.Ioctl(ioctlGetChipInfo, unsafe.Pointer(&c.ChipInfo)); err != nil {
+		f.Close()
+		return Chip{}, &OpError{Op: opOpen, Chip: path, Err: err}
 	}
 
-	var c Chip
-	c.fd = f.Fd()
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, c.fd, ioctlGetChipInfo, uintptr(unsafe.Pointer(&c.ChipInfo)))
-	if errno != 0 {
-		return c, errno
+	// kernels without the v2 API reject unknown ioctls with EINVAL,
+	// so probing a valid offset is enough to know which API to use
+	if c.lines > 0 {
+		var li lineInfoV2
+		c.v2 = c.f.Ioctl(ioctlGetLineInfoV2, unsafe.Pointer(&li)) == nil
 	}
 	return c, nil
 }
@@ -56,21 +75,71 @@ func (c Chip) Lines() int {
 }
 
 // Close releases resources helded by the chip.
+// Closing it again does nothing, other operations then return ErrClosed.
 func (c Chip) Close() error {
-	return syscall.Close(int(c.fd))
+	return c.f.Close()
 }
 
 // LineInfo returns informations about the requested line.
 func (c Chip) LineInfo(offset int) (LineInfo, error) {
+	li, err := c.lineInfo(offset)
+	if err != nil {
+		return LineInfo{}, &OpError{Op: opLineInfo, Chip: c.Name(), Offsets: []int{offset}, Err: err}
+	}
+	return li, nil
+}
+
+// lineInfo is the implementation of LineInfo.
+func (c Chip) lineInfo(offset int) (LineInfo, error) {
+	if err := checkOffsets([]int{offset}, c.Lines()); err != nil {
+		return LineInfo{}, err
+	}
+	if c.v2 {
+		var li lineInfoV2
+		li.offset = uint32(offset)
+		if err := c.f.Ioctl(ioctlGetLineInfoV2, unsafe.Pointer(&li)); err != nil {
+			return LineInfo{}, err
+		}
+		return lineInfoFromV2(li), nil
+	}
+
 	var li LineInfo
 	li.offset = uint32(offset)
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, c.fd, ioctlGetLineInfo, uintptr(unsafe.Pointer(&li)))
-	if errno != 0 {
-		return li, errno
+	if err := c.f.Ioctl(ioctlGetLineInfo, unsafe.Pointer(&li)); err != nil {
+		return li, err
 	}
 	return li, nil
 }
 
+// lineInfoFromV2 converts a v2 lineInfoV2 to a LineInfo.
+func lineInfoFromV2(li lineInfoV2) LineInfo {
+	var flags uint32
+	for _, f := range []struct {
+		v2 uint64
+		v1 uint32
+	}{
+		{lineFlagV2Used, lineFlagKernel},
+		{lineFlagV2Output, lineFlagIsOut},
+		{lineFlagV2ActiveLow, lineFlagActiveLow},
+		{lineFlagV2OpenDrain, lineFlagOpenDrain},
+		{lineFlagV2OpenSource, lineFlagOpenSource},
+		{lineFlagV2BiasPullUp, lineFlagBiasPullUp},
+		{lineFlagV2BiasPullDown, lineFlagBiasPullDown},
+		{lineFlagV2BiasDisabled, lineFlagDisable},
+	} {
+		if li.flags&f.v2 != 0 {
+			flags |= f.v1
+		}
+	}
+
+	return LineInfo{
+		offset:   li.offset,
+		flags:    flags,
+		name:     li.name,
+		consumer: li.consumer,
+	}
+}
+
 // Offset returns the offset number of the line.
 func (li LineInfo) Offset() int {
 	return int(li.offset)
@@ -131,14 +200,27 @@ func (li LineInfo) IsBiasPullDown() bool {
 	return li.flags&lineFlagBiasPullDown == lineFlagBiasPullDown
 }
 
-// NewHandleRequest prepare a HandleRequest
-func NewHandleRequest(offsets []int, flags HandleRequestFlag) *HandleRequest {
-	if len(offsets) > handlesMax {
-		panic(fmt.Sprintf("Number of requested lines exceeds maximum authorized (%d)", handlesMax))
-	}
+// HandleRequest represents at first a query to be sent to a chip to get control on a set of lines.
+// After be returned by the chip, it must be used to send or received data to lines.
+type HandleRequest struct {
+	handleRequest
+	debounce    time.Duration
+	clock       EventClock
+	lineConfigs map[int]LineConfig // configuration of lines by offset, overriding flags and debounce
+	err         error              // error found while preparing the request, returned by RequestLines
+	chip        string             // name of the chip, set once lines are requested
+	driver      LineDriver         // set once lines are requested
+}
 
+// NewHandleRequest prepare a HandleRequest.
+// If there is more than 64 offsets, RequestLines returns ErrTooManyLines.
+func NewHandleRequest(offsets []int, flags HandleRequestFlag) *HandleRequest {
 	hr := &HandleRequest{}
 	hr.flags = flags
+	if len(offsets) > handlesMax {
+		hr.err = ErrTooManyLines
+		return hr
+	}
 
 	for i := range offsets {
 		hr.lineOffsets[i] = uint32(offsets[i])
@@ -156,9 +238,11 @@ func (hr *HandleRequest) WithConsumer(consumer string) *HandleRequest {
 
 // WithDefaults set the default values for a prepared HandleRequest.
 // Note that setting default values on a InputLine is a nonsense but no error are returned.
+// If there is more than 64 default values, RequestLines returns ErrTooManyLines.
 func (hr *HandleRequest) WithDefaults(defaults []int) *HandleRequest {
 	if len(defaults) > handlesMax {
-		panic(fmt.Sprintf("Number of default values exceeds maximum authorized (%d)", handlesMax))
+		hr.err = ErrTooManyLines
+		return hr
 	}
 
 	for i := range defaults {
@@ -167,67 +251,375 @@ func (hr *HandleRequest) WithDefaults(defaults []int) *HandleRequest {
 	return hr
 }
 
+// WithDebounce set the debounce period for the input lines of a prepared HandleRequest.
+// Debouncing is done by the kernel and requires the v2 API, otherwise RequestLines returns ErrUnsupportedByKernel.
+func (hr *HandleRequest) WithDebounce(period time.Duration) *HandleRequest {
+	hr.debounce = period
+	return hr
+}
+
 // RequestLines takes a prepared HandleRequest and returns it ready to work.
 func (c Chip) RequestLines(request *HandleRequest) error {
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, c.fd, ioctlGetLineHandle, uintptr(unsafe.Pointer(request)))
-	if errno != 0 {
-		return errno
+	if err := c.requestLines(request); err != nil {
+		return &OpError{Op: opRequestLines, Chip: c.Name(), Offsets: request.Offsets(), Err: err}
 	}
+	request.chip = c.Name()
 	return nil
 }
 
+// requestLines is the implementation of RequestLines.
+func (c Chip) requestLines(request *HandleRequest) error {
+	if request.err != nil {
+		return request.err
+	}
+	if err := checkOffsets(request.Offsets(), c.Lines()); err != nil {
+		return err
+	}
+	if c.v2 {
+		return c.requestLinesV2(request)
+	}
+	if !request.uniformConfigs() || request.clock != ClockMonotonic {
+		return ErrUnsupportedByKernel
+	}
+
+	if err := c.f.Ioctl(ioctlGetLineHandle, unsafe.Pointer(&request.handleRequest)); err != nil {
+		return err
+	}
+	driver, err := newCdevLines(int(request.fd), false, &request.handleRequest, 0, ClockMonotonic)
+	if err != nil {
+		return err
+	}
+	request.driver = driver
+	return nil
+}
+
+// requestLinesV2 is the implementation of RequestLines for the v2 API.
+func (c Chip) requestLinesV2(hr *HandleRequest) error {
+	var lr lineRequestV2
+	copy(lr.offsets[:], hr.lineOffsets[:hr.lines])
+	lr.numLines = hr.lines
+	lr.consumer = hr.consumer
+	config, err := configV2(hr.LineConfigs(), defaultValuesBits(&hr.handleRequest), hr.clock)
+	if err != nil {
+		return err
+	}
+	lr.config = config
+
+	if err := c.f.Ioctl(ioctlGetLineV2, unsafe.Pointer(&lr)); err != nil {
+		return hr.clock.unsupported(err)
+	}
+	driver, err := newCdevLines(int(lr.fd), true, &hr.handleRequest, hr.debounce, hr.clock)
+	if err != nil {
+		return err
+	}
+	hr.driver = driver
+	return nil
+}
+
+// RequestEvents requests a line for edge detection, its events being read from the returned EventSource.
+// It is called by LineWatcher.Add.
+func (c Chip) RequestEvents(request EventRequest) (EventSource, error) {
+	src, err := c.requestEvents(request)
+	if err != nil {
+		return nil, &OpError{Op: opRequestEvents, Chip: c.Name(), Offsets: []int{request.Offset}, Err: err}
+	}
+	return src, nil
+}
+
+// requestEvents is the implementation of RequestEvents.
+func (c Chip) requestEvents(request EventRequest) (EventSource, error) {
+	if err := checkOffsets([]int{request.Offset}, c.Lines()); err != nil {
+		return nil, err
+	}
+	if c.v2 {
+		var lr lineRequestV2
+		lr.offsets[0] = uint32(request.Offset)
+		lr.numLines = 1
+		lr.consumer = stringToBytes(request.Consumer)
+		lr.config.flags = lineFlagV2Input | eventFlagsToV2(request.Flags) | request.Clock.flagsV2()
+		if request.Debounce > 0 {
+			lr.config.attrs[0] = lineConfigAttributeV2{attr: debounceAttributeV2(request.Debounce), mask: 1}
+			lr.config.numAttrs = 1
+		}
+
+		if err := c.f.Ioctl(ioctlGetLineV2, unsafe.Pointer(&lr)); err != nil {
+			return nil, request.Clock.unsupported(err)
+		}
+		return newCdevEventSource(int(lr.fd), true, request.Clock)
+	}
+	if request.Clock != ClockMonotonic {
+		return nil, ErrUnsupportedByKernel
+	}
+
+	el := EventLine{
+		lineOffset:  uint32(request.Offset),
+		handleFlags: HandleRequestInput,
+		eventFlags:  uint32(request.Flags),
+		consumer:    stringToBytes(request.Consumer),
+	}
+	if request.Debounce > 0 {
+		// the level of the line must be known after each edge to debounce it
+		el.eventFlags = uint32(BothEdges)
+	}
+	if err := c.f.Ioctl(ioctlGetLineEvent, unsafe.Pointer(&el)); err != nil {
+		return nil, err
+	}
+	es, err := newCdevEventSource(int(el.fd), false, ClockMonotonic)
+	if err != nil || request.Debounce == 0 {
+		return es, err
+	}
+
+	var data handleData
+	if err := es.f.Ioctl(ioctlHandleGetLineValues, unsafe.Pointer(&data)); err != nil {
+		es.Close()
+		return nil, err
+	}
+	if err := es.debounce(request.Flags, request.Debounce, int(data.values[0])); err != nil {
+		es.Close()
+		return nil, err
+	}
+	return es, nil
+}
+
+// debounceAttributeV2 returns the line attribute setting the debounce period.
+func debounceAttributeV2(period time.Duration) lineAttributeV2 {
+	attr := lineAttributeV2{id: lineAttrIDDebounce}
+	// debounce_period_us is the 32 bits member of the union stored in value
+	*(*uint32)(unsafe.Pointer(&attr.value)) = uint32(period / time.Microsecond)
+	return attr
+}
+
+// handleFlagsToV2 converts HandleRequest flags to v2 line flags.
+func handleFlagsToV2(flags HandleRequestFlag) uint64 {
+	var v2 uint64
+	for _, f := range []struct {
+		v1 HandleRequestFlag
+		v2 uint64
+	}{
+		{HandleRequestInput, lineFlagV2Input},
+		{HandleRequestOutput, lineFlagV2Output},
+		{HandleRequestActiveLow, lineFlagV2ActiveLow},
+		{HandleRequestOpenDrain, lineFlagV2OpenDrain},
+		{HandleRequestOpenSource, lineFlagV2OpenSource},
+		{HandleRequestBiasPullUp, lineFlagV2BiasPullUp},
+		{HandleRequestBiasPullDown, lineFlagV2BiasPullDown},
+		{HandleRequestBiasDisable, lineFlagV2BiasDisabled},
+	} {
+		if flags&f.v1 == f.v1 {
+			v2 |= f.v2
+		}
+	}
+	return v2
+}
+
+// eventFlagsToV2 converts EventRequestFlags to v2 line flags.
+func eventFlagsToV2(flags EventRequestFlags) uint64 {
+	var v2 uint64
+	if flags&RisingEdge == RisingEdge {
+		v2 |= lineFlagV2EdgeRising
+	}
+	if flags&FallingEdge == FallingEdge {
+		v2 |= lineFlagV2EdgeFalling
+	}
+	return v2
+}
+
+// linesMask returns the v2 mask selecting the n first lines of a request.
+func linesMask(n uint32) uint64 {
+	if n >= linesMaxV2 {
+		return ^uint64(0)
+	}
+	return 1<<n - 1
+}
+
 // Reads return values read from the lines handled by the HandleRequest.
 // The second return parameter contains all values returned as an array.
-// The first one is the first element of this array, useful when dealing with 1 line HandleRequest.
+// The first one is the first element of this array, useful when dealing with 1 line HandleRequest,
+// or 0 if the HandleRequest has no lines.
 func (hr *HandleRequest) Read() (int, []int, error) {
-	if hr.flags&lineFlagIsOut == lineFlagIsOut {
-		return 0, []int{}, ErrOperationNotPermitted
+	valueN := make([]int, hr.lines)
+	if _, err := hr.ReadInto(valueN); err != nil {
+		return 0, []int{}, err
+	}
+	if hr.lines == 0 {
+		return 0, valueN, nil
 	}
+	return valueN[0], valueN, nil
+}
 
-	in := handleData{}
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(hr.fd), ioctlHandleGetLineValues, uintptr(unsafe.Pointer(&in)))
-	if errno != 0 {
-		return 0, []int{}, errno
+// ReadInto reads the values of the lines handled by the HandleRequest into values, without allocating.
+// It returns the number of values read, which is the smaller of len(values) and the number of lines.
+func (hr *HandleRequest) ReadInto(values []int) (int, error) {
+	bits, err := hr.ReadMask()
+	if err != nil {
+		return 0, err
+	}
+	n := len(values)
+	if n > int(hr.lines) {
+		n = int(hr.lines)
 	}
+	for i := 0; i < n; i++ {
+		values[i] = int(bits >> uint(i) & 1)
+	}
+	return n, nil
+}
 
-	switch len(in.values) {
-	case 1:
-		return int(in.values[0]), []int{int(in.values[0])}, nil
-	default:
-		valueN := make([]int, len(in.values))
-		for i := range in.values {
-			valueN[i] = int(in.values[i])
-		}
-		return valueN[0], valueN, nil
+// ReadMask returns the values of the lines handled by the HandleRequest as a bitmap,
+// the bit i being the value of the i-th line.
+func (hr *HandleRequest) ReadMask() (uint64, error) {
+	if !hr.anyLine(HandleRequestInput) && hr.flags&HandleRequestOutput == HandleRequestOutput {
+		return 0, ErrOperationNotPermitted
+	}
+	if hr.driver == nil {
+		return 0, ErrNotRequested
+	}
+
+	bits, err := hr.driver.GetValues(linesMask(hr.lines))
+	if err != nil {
+		return 0, hr.opError(opRead, err)
 	}
+	return bits, nil
 }
 
 // Write writes values to the lines handled by the HandleRequest.
 // If there is more values ​​supplied than lines managed by the HandleRequest, excess values ​​are silently ignored.
+// Lines for which no value is supplied are set to zero, use SetValues to keep their values.
 func (hr *HandleRequest) Write(value0 int, valueN ...int) error {
-	if !(hr.flags&lineFlagIsOut == lineFlagIsOut) {
-		return ErrOperationNotPermitted
-	}
+	return hr.WriteMask(hr.valuesBits(value0, valueN), linesMask(hr.lines))
+}
 
-	out := handleData{}
-	out.values[0] = uint8(value0)
+// valuesBits returns the values of the lines given to Write as a bitmap.
+func (hr *HandleRequest) valuesBits(value0 int, valueN []int) uint64 {
+	var bits uint64
+	if value0 != 0 {
+		bits = 1
+	}
 	for i := range valueN {
 		if i >= int(hr.lines)-1 {
 			break
 		}
-		out.values[i+1] = uint8(valueN[i])
+		if valueN[i] != 0 {
+			bits |= 1 << uint(i+1)
+		}
 	}
+	return bits
+}
 
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(hr.fd), ioctlHandleSetLineValues, uintptr(unsafe.Pointer(&out)))
-	if errno != 0 {
-		return errno
+// WriteMask writes values to the lines handled by the HandleRequest whose bit is set in mask,
+// the bit i being the value of the i-th line. Other lines, including input ones, keep their values.
+func (hr *HandleRequest) WriteMask(values, mask uint64) error {
+	if !hr.anyLine(HandleRequestOutput) {
+		return ErrOperationNotPermitted
+	}
+	if hr.driver == nil {
+		return ErrNotRequested
+	}
+
+	if err := hr.driver.SetValues(values, mask&hr.outputsMask()); err != nil {
+		return hr.opError(opWrite, err)
+	}
+	return nil
+}
+
+// SetValues writes values to some lines handled by the HandleRequest, values being indexed by line offsets.
+// Other lines keep their values: the v2 API writes only the lines given, with the v1 API
+// the other lines are written again with the last values written.
+func (hr *HandleRequest) SetValues(values map[int]int) error {
+	bits, mask, err := hr.offsetsBits(values)
+	if err != nil {
+		return err
+	}
+	return hr.WriteMask(bits, mask)
+}
+
+// SetValue writes the value of one line handled by the HandleRequest, other lines keep their values.
+func (hr *HandleRequest) SetValue(offset int, value int) error {
+	i, err := hr.index(offset)
+	if err != nil {
+		return err
+	}
+	var bits uint64
+	if value != 0 {
+		bits = 1 << uint(i)
+	}
+	return hr.WriteMask(bits, 1<<uint(i))
+}
+
+// offsetsBits returns values indexed by line offsets as a bitmap and the mask of the lines concerned.
+func (hr *HandleRequest) offsetsBits(values map[int]int) (bits uint64, mask uint64, err error) {
+	for offset, value := range values {
+		i, err := hr.index(offset)
+		if err != nil {
+			return 0, 0, err
+		}
+		mask |= 1 << uint(i)
+		if value != 0 {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, mask, nil
+}
+
+// index returns the index of the line at offset in the HandleRequest.
+func (hr *HandleRequest) index(offset int) (int, error) {
+	for i := uint32(0); i < hr.lines; i++ {
+		if int(hr.lineOffsets[i]) == offset {
+			return int(i), nil
+		}
+	}
+	return 0, &OpError{Op: opWrite, Chip: hr.chip, Offsets: []int{offset}, Err: ErrInvalidOffset}
+}
+
+// Reconfigure changes the flags and the default values of lines already held by the HandleRequest,
+// without releasing them. Default values are only meaningful when switching to output.
+// The flags apply to all the lines, configurations set by WithLineConfig are dropped.
+// With the v1 API, it requires Linux 5.5 or later, otherwise ErrUnsupportedByKernel is returned.
+func (hr *HandleRequest) Reconfigure(flags HandleRequestFlag, defaults []int) error {
+	if len(defaults) > handlesMax {
+		return hr.opError(opReconfigure, ErrTooManyLines)
+	}
+	if hr.driver == nil {
+		return ErrNotRequested
+	}
+
+	if err := hr.driver.Reconfigure(flags, defaults); err != nil {
+		return hr.opError(opReconfigure, err)
+	}
+	hr.flags = flags
+	hr.lineConfigs = nil
+	hr.defaultValues = [handlesMax]uint8{}
+	for i := range defaults {
+		hr.defaultValues[i] = uint8(defaults[i])
 	}
 	return nil
 }
 
 // Close releases resources helded by the HandleRequest.
-func (hr HandleRequest) Close() error {
-	return syscall.Close(int(hr.fd))
+// Closing it again does nothing, other operations then return ErrClosed.
+func (hr *HandleRequest) Close() error {
+	if hr.driver == nil {
+		return ErrNotRequested
+	}
+	if err := hr.driver.Close(); err != nil {
+		return hr.opError(opClose, err)
+	}
+	return nil
+}
+
+// opError returns the OpError for an operation on the lines of the HandleRequest.
+func (hr *HandleRequest) opError(op string, err error) error {
+	return &OpError{Op: op, Chip: hr.chip, Offsets: hr.Offsets(), Err: err}
+}
+
+// Event represents a occurred event.
+type Event struct {
+	Timestamp uint64     // nanoseconds, as provided by the kernel from Clock
+	ID        uint32     // type of the event (rising or falling edge)
+	Chip      string     // name of the chip the line belongs to
+	Offset    int        // offset of the line on the chip
+	Consumer  string     // consumer set when the line was added to the LineWatcher
+	LineSeqno uint32     // sequence number of the event on its line, starting at 1
+	Clock     EventClock // clock of the timestamp
 }
 
 // IsRising returns true for event on a rising edge.
@@ -241,131 +633,270 @@ func (e Event) IsFalling() bool {
 }
 
 // LineWatcher is a receiver of events for a set of event lines.
+// Lines can be added, removed or listed while another goroutine waits for events.
+// Only one call can wait for events at a time: while Wait, WaitContext, WaitForEver, RunContext
+// or the goroutine started by Events is waiting, the others return ErrWaitInProgress.
 type LineWatcher struct {
-	epfd int
-	efds []int
+	feed eventsFeed // first field to be 64 bits aligned for atomic operations
+	poller
+	efds     map[int]*watchedLine // event lines indexed by the fd waited for
+	pending  []Event              // events read, delivered from pending[next]
+	next     int
+	epollEvs [16]unix.EpollEvent // ready file descriptors, reused by each wait
+
+	mu     sync.Mutex     // protects efds and onLost
+	onLost LostEventsFunc // called when events dropped by the kernel are detected
+}
+
+// watchedLine is an event line added to a LineWatcher.
+type watchedLine struct {
+	chip     string
+	offset   int
+	flags    EventRequestFlags
+	consumer string
+	src      EventSource
+	seqno    uint32 // sequence number of the last event read
+	lost     uint64 // events dropped by the kernel
+}
+
+// info returns the description of the watched line.
+func (wl *watchedLine) info() WatchedLine {
+	return WatchedLine{Chip: wl.chip, Offset: wl.offset, Flags: wl.flags, Consumer: wl.consumer, Lost: wl.lost}
+}
+
+// WatchOption is an optional setting for a line added to a LineWatcher.
+type WatchOption func(*EventRequest)
+
+// WithDebounce sets the debounce period of a watched line.
+// Debouncing is done by the kernel with the v2 API, otherwise it is done in software.
+func WithDebounce(period time.Duration) WatchOption {
+	return func(r *EventRequest) {
+		r.Debounce = period
+	}
 }
 
 // NewLineWatcher initializes a new LineWatcher.
-func NewLineWatcher() (LineWatcher, error) {
-	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
-	return LineWatcher{epfd: fd}, err
+func NewLineWatcher() (*LineWatcher, error) {
+	p, err := newPoller()
+	return &LineWatcher{poller: p, efds: make(map[int]*watchedLine)}, err
 }
 
 // Close releases resources helded by the LineWatcher.
 func (lw *LineWatcher) Close() error {
-	err := unix.Close(lw.epfd)
-	for _, fd := range lw.efds {
-		unix.Close(fd) // TODO: concatenate errors
+	err := lw.close()
+	lw.mu.Lock()
+	for _, wl := range lw.efds {
+		wl.src.Close() // TODO: concatenate errors
 	}
+	lw.efds = make(map[int]*watchedLine)
+	lw.mu.Unlock()
 	return err
 }
 
 // Add adds a new line to watch to the LineWatcher.
-func (lw *LineWatcher) Add(chip Chip, line int, flags EventRequestFlags, consumer string) error {
-	el := EventLine{
-		lineOffset:  uint32(line),
-		handleFlags: HandleRequestInput,
-		eventFlags:  uint32(flags),
-		consumer:    stringToBytes(consumer),
+func (lw *LineWatcher) Add(chip GPIOChip, line int, flags EventRequestFlags, consumer string, options ...WatchOption) error {
+	request := EventRequest{Offset: line, Flags: flags, Consumer: consumer}
+	for _, option := range options {
+		option(&request)
 	}
 
-	_, _, errno := unix.Syscall(unix.SYS_IOCTL, chip.fd, ioctlGetLineEvent, uintptr(unsafe.Pointer(&el)))
-	if errno != 0 {
-		return errno
+	src, err := chip.RequestEvents(request)
+	if err != nil {
+		return err
 	}
-	// an application that employs the EPOLLET flag should use nonblocking file descriptors (man epoll)
-	unix.SetNonblock(int(el.fd), true)
 
-	// add the EventLine fd to the epoll instance
-	var epEvent unix.EpollEvent
-	epEvent.Events = unix.EPOLLIN | unix.EPOLLET
-	epEvent.Fd = int32(el.fd)
-	if err := unix.EpollCtl(lw.epfd, unix.EPOLL_CTL_ADD, int(el.fd), &epEvent); err != nil {
+	// add the event line fd to the epoll instance, registering it first in efds
+	// so that the events are not ignored if a waiting call receives them immediately
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	fd := src.Fd()
+	lw.efds[fd] = &watchedLine{chip: chip.Name(), offset: line, flags: flags, consumer: consumer, src: src}
+
+	if err := lw.add(fd, pollEvents(src)|unix.EPOLLET); err != nil {
+		delete(lw.efds, fd)
+		src.Close()
 		return err
 	}
-	lw.efds = append(lw.efds, int(el.fd))
 
 	return nil
 }
 
-// Wait waits for first occurrence of an event on one of the event lines.
-func (lw *LineWatcher) Wait() (Event, error) {
-	var events [1]unix.EpollEvent
-	for {
-		_, err := unix.EpollWait(lw.epfd, events[:], -1)
-		if err != nil {
-			if err == unix.EINTR {
-				continue
-			}
-			return Event{}, err
+// Remove stops watching a line previously added to the LineWatcher and releases it.
+// Events already read on the line can still be delivered.
+func (lw *LineWatcher) Remove(chip GPIOChip, line int) error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	for fd, wl := range lw.efds {
+		if wl.chip == chip.Name() && wl.offset == line {
+			delete(lw.efds, fd)
+			lw.remove(fd)
+			return wl.src.Close()
 		}
+	}
+	return ErrLineNotWatched
+}
 
-		ev := events[0]
-		if ev.Events&unix.EPOLLIN != 0 {
-			evds, err := readEventsData(int(ev.Fd))
-			if err != nil {
-				return Event{}, err
-			}
-			return evds[0], nil
+// WatchedLine describes a line watched by a LineWatcher.
+type WatchedLine struct {
+	Chip     string // name of the chip the line belongs to
+	Offset   int
+	Flags    EventRequestFlags
+	Consumer string
+	Lost     uint64 // events dropped by the kernel, detected with the v2 API only
+}
+
+// Watched returns the lines currently watched by the LineWatcher, sorted by chip and offset.
+func (lw *LineWatcher) Watched() []WatchedLine {
+	lw.mu.Lock()
+	lines := make([]WatchedLine, 0, len(lw.efds))
+	for _, wl := range lw.efds {
+		lines = append(lines, wl.info())
+	}
+	lw.mu.Unlock()
+
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Chip != lines[j].Chip {
+			return lines[i].Chip < lines[j].Chip
 		}
+		return lines[i].Offset < lines[j].Offset
+	})
+	return lines
+}
+
+// Stop stops the LineWatcher, waiting calls return as soon as the events already read are delivered.
+// Once stopped, WaitForEver and RunContext return nil, Wait and WaitContext return ErrWatcherStopped.
+func (lw *LineWatcher) Stop() error {
+	return lw.stop()
+}
+
+// Wait waits for first occurrence of an event on one of the event lines.
+func (lw *LineWatcher) Wait() (Event, error) {
+	return lw.WaitContext(context.Background())
+}
+
+// WaitContext waits for first occurrence of an event on one of the event lines, or until ctx is done.
+// When reading a line fails, the error is returned once the other lines are read, their events being
+// delivered by the next calls.
+func (lw *LineWatcher) WaitContext(ctx context.Context) (Event, error) {
+	if err := lw.guard.enter(); err != nil {
+		return Event{}, err
+	}
+	defer lw.guard.leave()
+	defer lw.watchContext(ctx)()
+
+	if err := lw.poll(ctx); err != nil {
+		return Event{}, err
 	}
+	return lw.pop(), nil
 }
 
 // EventHandlerFunc is the type of the function called for each event retrieved by WaitForEver.
 type EventHandlerFunc func(evd Event)
 
-// WaitForEver waits indefinitely for events on the event lines.
+// WaitForEver waits indefinitely for events on the event lines, until the LineWatcher is stopped.
 // Note that for one event, more than one EventData can be retrieved on the event line.
 func (lw *LineWatcher) WaitForEver(handler EventHandlerFunc) error {
-	events := make([]unix.EpollEvent, len(lw.efds))
+	return lw.RunContext(context.Background(), handler)
+}
+
+// RunContext waits for events on the event lines and calls handler for each of them,
+// until the LineWatcher is stopped or ctx is done. In the latter case, the context error is returned.
+func (lw *LineWatcher) RunContext(ctx context.Context, handler EventHandlerFunc) error {
+	if err := lw.guard.enter(); err != nil {
+		return err
+	}
+	defer lw.guard.leave()
+	defer lw.watchContext(ctx)()
+
 	for {
-		nevents, err := unix.EpollWait(lw.epfd, events[:], -1)
-		if err != nil {
-			if err == unix.EINTR {
-				continue
+		if err := lw.poll(ctx); err != nil {
+			if err == ErrWatcherStopped {
+				return nil
 			}
 			return err
 		}
-
-		for i := 0; i < nevents; i++ {
-			ev := events[i]
-			if ev.Events&unix.EPOLLIN != 0 {
-				evds, err := readEventsData(int(ev.Fd))
-				if err != nil {
-					return err
-				}
-				for _, evd := range evds {
-					handler(evd)
-				}
-			}
+		for lw.next < len(lw.pending) {
+			handler(lw.pop())
 		}
 	}
 }
 
-// readEventsData that retrieves all event data that can be retrieved on a event line.
-// The event line is fully drained when read receives EAGAIN.
-func readEventsData(fd int) ([]Event, error) {
-	const BufferSize = 16 // How to know that buffer size must be 16, GPIOEventData = uint64 + uint32 = 8 + 4 = 12 ?
+// pop returns the next pending event.
+func (lw *LineWatcher) pop() Event {
+	evd := lw.pending[lw.next]
+	lw.next++
+	return evd
+}
 
-	var evds []Event
-	var evd Event
-	var buffer = make([]byte, BufferSize)
-	for {
-		_, err := unix.Read(fd, buffer)
+// poll waits until there are pending events, the LineWatcher is stopped or ctx is done.
+// Once all pending events are delivered, their buffer is reused so that waiting does not allocate.
+func (lw *LineWatcher) poll(ctx context.Context) error {
+	if lw.next == len(lw.pending) {
+		lw.pending = lw.pending[:0]
+		lw.next = 0
+	}
+	for len(lw.pending) == 0 {
+		nevents, stopped, err := lw.wait(ctx, lw.epollEvs[:])
 		if err != nil {
-			if err == unix.EAGAIN {
-				return evds, nil
-			}
-			return evds, err
+			return err
 		}
 
-		err = binary.Read(bytes.NewReader(buffer), binary.LittleEndian, &evd)
+		// every ready line is read so that the events of the other lines are not held back by an error,
+		// the first one being returned once they are pending
+		for _, ev := range lw.epollEvs[:nevents] {
+			// a line whose chip has been removed is not readable but hung up, reading it returns the error
+			if ev.Events&(unix.EPOLLIN|unix.EPOLLPRI|unix.EPOLLHUP|unix.EPOLLERR) != 0 {
+				evds, rerr := lw.readEvents(int(ev.Fd))
+				lw.pending = append(lw.pending, evds...)
+				if err == nil {
+					err = rerr
+				}
+			}
+		}
 		if err != nil {
-			return evds, err
+			return err
+		}
+		if stopped && len(lw.pending) == 0 {
+			return ErrWatcherStopped
+		}
+	}
+	return nil
+}
+
+// readEvents retrieves all events available on a watched event line.
+// Events are completed with the informations about the line they came from,
+// and the gaps in their sequence numbers are counted as lost events.
+func (lw *LineWatcher) readEvents(fd int) ([]Event, error) {
+	lw.mu.Lock()
+	wl, ok := lw.efds[fd]
+	if !ok {
+		lw.mu.Unlock()
+		return nil, nil // removed while the waiting call was woken up
+	}
+	evds, err := wl.src.ReadEvents()
+	var lost uint64
+	for i := range evds {
+		evds[i].Chip = wl.chip
+		evds[i].Offset = wl.offset
+		evds[i].Consumer = wl.consumer
+		if evds[i].LineSeqno != wl.seqno+1 {
+			lost += uint64(evds[i].LineSeqno - wl.seqno - 1)
 		}
-		evds = append(evds, evd)
+		wl.seqno = evds[i].LineSeqno
+	}
+	wl.lost += lost
+	line, onLost := wl.info(), lw.onLost
+	lw.mu.Unlock()
+
+	// called without holding the lock, so that it can use the LineWatcher
+	if lost > 0 && onLost != nil {
+		onLost(line, lost)
 	}
+	if err != nil {
+		return evds, &OpError{Op: opRead, Chip: line.Chip, Offsets: []int{line.Offset}, Err: err}
+	}
+	return evds, nil
 }
 
 // bytesToString is a helper function to convert raw string as stored in Linux structure to Go string.
@@ -390,5 +921,58 @@ func stringToBytes(s string) [32]byte {
 	return b
 }
 
+// kernelAtLeast returns true if the running kernel version is at least major.minor.
+func kernelAtLeast(major, minor int) bool {
+	kernelVersionOnce.Do(func() {
+		var uts unix.Utsname
+		if err := unix.Uname(&uts); err != nil {
+			return
+		}
+		fmt.Sscanf(unix.ByteSliceToString(uts.Release[:]), "%d.%d", &kernelVersion[0], &kernelVersion[1])
+	})
+	if kernelVersion[0] != major {
+		return kernelVersion[0] > major
+	}
+	return kernelVersion[1] >= minor
+}
+
+var (
+	kernelVersion     [2]int
+	kernelVersionOnce sync.Once
+)
+
+// unsupportedBefore returns ErrUnsupportedByKernel instead of err when err is the EINVAL
+// with which a kernel older than major.minor rejects an ioctl it does not know.
+// The ioctl being tried first, kernels with the operation backported are not refused.
+func unsupportedBefore(err error, major, minor int) error {
+	if err == unix.EINVAL && !kernelAtLeast(major, minor) {
+		return ErrUnsupportedByKernel
+	}
+	return err
+}
+
 // ErrOperationNotPermitted is returned when trying to read on an output line or to write on a input line.
 var ErrOperationNotPermitted = errors.New("operation not permitted")
+
+// ErrNotRequested is returned when using a HandleRequest whose lines have not been requested.
+var ErrNotRequested = errors.New("lines not requested")
+
+// ErrLineNotWatched is returned when removing a line not watched by a LineWatcher.
+var ErrLineNotWatched = errors.New("line not watched")
+
+// ErrWatcherStopped is returned when waiting on a LineWatcher which has been stopped.
+var ErrWatcherStopped = errors.New("line watcher stopped")
+
+// ErrWaitInProgress is returned when waiting on a watcher while another call is waiting on it.
+var ErrWaitInProgress = errors.New("another call is waiting")
+
+// ErrClosed is returned when using a chip or lines which have been closed.
+// It is os.ErrClosed, so that errors.Is(err, os.ErrClosed) also holds.
+var ErrClosed = os.ErrClosed
+
+// ErrUnsupportedByKernel is returned when the running kernel does not support the requested operation.
+// As the kernel rejects the ioctls it does not know with EINVAL, like invalid arguments, the operations
+// introduced by a given Linux version report their EINVAL as ErrUnsupportedByKernel when uname gives
+// an older version. A distribution kernel with backports may thus report it although the operation
+// is merely given invalid arguments.
+var ErrUnsupportedByKernel = errors.New("operation not supported by the kernel")
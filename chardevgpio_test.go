@@ -6,12 +6,15 @@
 package chardevgpio_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	gpio "github.com/vinymeuh/chardevgpio"
 )
@@ -23,30 +26,38 @@ func newChip(t *testing.T) gpio.Chip {
 }
 
 func TestChip(t *testing.T) {
+	requireMockup(t)
 	// error cases
 	_, err := gpio.NewChip("/does/not/exist")
 	assert.Error(t, err, "opening a non existing file should fail")
-	assert.Truef(t, os.IsNotExist(err), "wrong err when opening a non existing file: %s", err)
+	assert.Truef(t, errors.Is(err, os.ErrNotExist), "wrong err when opening a non existing file: %s", err)
 
 	_, err = gpio.NewChip("/dev/zero")
 	assert.Error(t, err, "opening a invalid GPIO device should fail")
+	assert.Truef(t, errors.Is(err, gpio.ErrNotGPIOChip), "wrong err when opening a invalid GPIO device: %s", err)
 
 	// normal case
 	c := newChip(t)
 	assert.Equal(t, mockChip.Name, c.Name(), "wrong value for chip name")
 	assert.Equal(t, mockChip.Label, c.Label(), "wrong value for chip label")
 	assert.Equal(t, mockChip.Lines, c.Lines(), "wrong value for number of lines managed by the chip")
+	copied := c
 	assert.NoErrorf(t, c.Close(), "error while closing the chip")
-	assert.Errorf(t, c.Close(), "double close a chip should return an error")
+	assert.NoErrorf(t, c.Close(), "double close a chip should do nothing")
+	assert.NoErrorf(t, copied.Close(), "closing a copy of a closed chip should do nothing")
+	_, err = copied.LineInfo(0)
+	assert.Truef(t, errors.Is(err, gpio.ErrClosed), "wrong err when using a closed chip: %s", err)
 }
 
 func TestLineInfo(t *testing.T) {
+	requireMockup(t)
 	var c gpio.Chip
 
 	// error cases
 	c = newChip(t)
 	_, err := c.LineInfo(mockChip.Lines + 1)
 	assert.Errorf(t, err, "requesting a LineInfo with invalide offset should fail")
+	assert.Truef(t, errors.Is(err, gpio.ErrInvalidOffset), "wrong err when requesting a LineInfo with invalid offset: %s", err)
 	c.Close()
 
 	// normal case
@@ -63,24 +74,73 @@ func TestLineInfo(t *testing.T) {
 }
 
 func TestHandleRequest(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+	defer c.Close()
+
 	// prepare request for more that 64 offsets or default values
 	toomany := make([]int, 128, 128)
-	assert.Panics(t, func() { gpio.NewHandleRequest(toomany, gpio.HandleRequestOutput) })
-	assert.Panics(t, func() { gpio.NewHandleRequest([]int{0}, gpio.HandleRequestOutput).WithDefaults(toomany) })
+	var hr *gpio.HandleRequest
+	assert.NotPanics(t, func() { hr = gpio.NewHandleRequest(toomany, gpio.HandleRequestOutput) })
+	assert.True(t, errors.Is(c.RequestLines(hr), gpio.ErrTooManyLines), "requesting too many lines should fail")
+	assert.NotPanics(t, func() { hr = gpio.NewHandleRequest([]int{0}, gpio.HandleRequestOutput).WithDefaults(toomany) })
+	assert.True(t, errors.Is(c.RequestLines(hr), gpio.ErrTooManyLines), "giving too many default values should fail")
+
+	// request for an invalid offset
+	hr = gpio.NewHandleRequest([]int{0, mockChip.Lines}, gpio.HandleRequestInput)
+	err := c.RequestLines(hr)
+	assert.True(t, errors.Is(err, gpio.ErrInvalidOffset), "requesting an invalid offset should fail")
+	var opErr *gpio.OpError
+	if assert.True(t, errors.As(err, &opErr), "error should be an OpError") {
+		assert.Equal(t, "request lines", opErr.Op)
+		assert.Equal(t, mockChip.Name, opErr.Chip)
+		assert.Equal(t, []int{0, mockChip.Lines}, opErr.Offsets)
+	}
+}
+
+func TestHandleRequestNoLines(t *testing.T) {
+	chip := newFakeChip(t, "fake-A", 4)
+	hr := gpio.NewHandleRequest([]int{}, gpio.HandleRequestInput)
+	assert.NoError(t, chip.RequestLines(hr), "unable to request no lines")
+	defer hr.Close()
+
+	var (
+		value0 int
+		values []int
+		err    error
+	)
+	assert.NotPanics(t, func() { value0, values, err = hr.Read() })
+	assert.NoError(t, err)
+	assert.Equal(t, 0, value0)
+	assert.Empty(t, values)
+}
+
+func TestRequestLineClosed(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+	defer c.Close()
+
+	l := gpio.NewHandleRequest([]int{0}, gpio.HandleRequestOutput)
+	assert.NoError(t, c.RequestLines(l), "unable to request line")
+	assert.NoError(t, l.Close(), "error while closing the line")
+	assert.NoError(t, l.Close(), "double close a line should do nothing")
+	assert.True(t, errors.Is(l.Write(1), gpio.ErrClosed), "wrong err when using a closed line")
 }
 
 func TestRequestLineBusy(t *testing.T) {
+	requireMockup(t)
 	c := newChip(t)
 
 	li := gpio.NewHandleRequest([]int{0}, gpio.HandleRequestOutput)
 	c.RequestLines(li)
-	assert.Errorf(t, c.RequestLines(li), "should have return a 'device or resource busy' error")
+	assert.Truef(t, errors.Is(c.RequestLines(li), gpio.ErrLineBusy), "should have return a 'device or resource busy' error")
 	li.Close()
 
 	c.Close()
 }
 
 func TestRequestLine(t *testing.T) {
+	requireMockup(t)
 	testCases := []struct {
 		offsets   []int
 		direction gpio.HandleRequestFlag
@@ -151,7 +211,132 @@ func TestRequestLine(t *testing.T) {
 	}
 }
 
+func TestRequestLineReconfigure(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+
+	l := gpio.NewHandleRequest([]int{0}, gpio.HandleRequestOutput).WithConsumer("reconfigure")
+	assert.NoError(t, c.RequestLines(l), "unable to request line")
+
+	err := l.Reconfigure(gpio.HandleRequestInput|gpio.HandleRequestActiveLow, nil)
+	if errors.Is(err, gpio.ErrUnsupportedByKernel) {
+		l.Close()
+		c.Close()
+		t.Skip("reconfiguring lines requires Linux 5.5 or later")
+	}
+	assert.NoError(t, err, "unable to reconfigure line as input")
+
+	li, err := c.LineInfo(0)
+	assert.NoError(t, err, "unable to request line info")
+	assert.True(t, li.IsInput(), "should be an input line")
+	assert.True(t, li.IsActiveLow(), "should be active low")
+	assert.Equal(t, "reconfigure", li.Consumer(), "line should still be held by the request")
+	assert.Error(t, l.Write(1), "writing to a line reconfigured as input should fail")
+
+	assert.NoError(t, l.Reconfigure(gpio.HandleRequestOutput, []int{1}), "unable to reconfigure line as output")
+	li, err = c.LineInfo(0)
+	assert.NoError(t, err, "unable to request line info")
+	assert.True(t, li.IsOutput(), "should be an output line")
+	mockread, err := mockChip.Read()
+	assert.NoError(t, err, "unable to read using mockChip")
+	assert.Equal(t, 1, mockread[0], "default value does not match")
+
+	l.Close()
+	c.Close()
+}
+
+func TestRequestLineDebounce(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+
+	l := gpio.NewHandleRequest([]int{0}, gpio.HandleRequestInput).WithDebounce(10 * time.Millisecond)
+	err := c.RequestLines(l)
+	if errors.Is(err, gpio.ErrUnsupportedByKernel) {
+		c.Close()
+		t.Skip("debouncing input lines requires the v2 API")
+	}
+	assert.NoError(t, err, "unable to request debounced line")
+
+	assert.NoError(t, mockChip.Write([]int{1}), "unable to write using mockChip")
+	time.Sleep(50 * time.Millisecond)
+	value, _, err := l.Read()
+	assert.NoError(t, err, "unable to read from debounced line")
+	assert.Equal(t, 1, value, "wrong value read from debounced line")
+
+	l.Close()
+	c.Close()
+}
+
+func TestRequestLineConfig(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+
+	l := gpio.NewHandleRequest([]int{0, 1}, gpio.HandleRequestInput).
+		WithDefaults([]int{0, 1}).
+		WithLineConfig(1, gpio.LineConfig{Flags: gpio.HandleRequestOutput})
+	err := c.RequestLines(l)
+	if errors.Is(err, gpio.ErrUnsupportedByKernel) {
+		c.Close()
+		t.Skip("mixing input and output lines requires the v2 API")
+	}
+	assert.NoError(t, err, "unable to request mixed lines")
+
+	li, err := c.LineInfo(0)
+	assert.NoError(t, err)
+	assert.True(t, li.IsInput(), "line 0 should be an input")
+	li, err = c.LineInfo(1)
+	assert.NoError(t, err)
+	assert.True(t, li.IsOutput(), "line 1 should be an output")
+
+	assert.NoError(t, mockChip.Write([]int{1}), "unable to write using mockChip")
+	value, _, err := l.Read()
+	assert.NoError(t, err, "unable to read from mixed lines")
+	assert.Equal(t, 1, value, "wrong value read from input line")
+
+	assert.NoError(t, l.SetValue(1, 0), "unable to write to output line")
+	mockread, err := mockChip.Read()
+	assert.NoError(t, err, "unable to read using mockChip")
+	assert.Equal(t, 0, mockread[1], "wrong value written to output line")
+
+	l.Close()
+	c.Close()
+}
+
+func TestHandleRequestLineConfig(t *testing.T) {
+	chip := newFakeChip(t, "fake-A", 4)
+
+	hr := gpio.NewHandleRequest([]int{0, 1, 2}, gpio.HandleRequestInput).
+		WithDefaults([]int{0, 1, 0}).
+		WithLineConfig(1, gpio.LineConfig{Flags: gpio.HandleRequestOutput}).
+		WithLineConfig(2, gpio.LineConfig{Flags: gpio.HandleRequestInput | gpio.HandleRequestActiveLow})
+	require.Nil(t, chip.RequestLines(hr))
+	defer hr.Close()
+
+	li, _ := chip.LineInfo(0)
+	assert.True(t, li.IsInput())
+	li, _ = chip.LineInfo(1)
+	assert.True(t, li.IsOutput())
+	li, _ = chip.LineInfo(2)
+	assert.True(t, li.IsActiveLow())
+	level, _ := chip.Level(1)
+	assert.Equal(t, 1, level)
+
+	chip.SetLevel(0, 1)
+	chip.SetLevel(2, 1)
+	_, values, err := hr.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1, 1, 0}, values)
+
+	assert.Nil(t, hr.Write(0, 0, 0)) // input lines are left untouched
+	level, _ = chip.Level(1)
+	assert.Equal(t, 0, level)
+	assert.Nil(t, hr.SetValue(1, 1))
+	level, _ = chip.Level(1)
+	assert.Equal(t, 1, level)
+}
+
 func TestRequestLineErrOperationNotPermitted(t *testing.T) {
+	requireMockup(t)
 	c := newChip(t)
 
 	l := gpio.NewHandleRequest([]int{0}, gpio.HandleRequestOutput)
@@ -172,6 +357,7 @@ func TestRequestLineErrOperationNotPermitted(t *testing.T) {
 }
 
 func TestRequestLineInputRead(t *testing.T) {
+	requireMockup(t)
 	testCases := []struct {
 		data []int
 	}{
@@ -191,6 +377,7 @@ func TestRequestLineInputRead(t *testing.T) {
 
 		_, read, err := l.Read()
 		assert.NoError(t, err, "unable to read from input line")
+		assert.Len(t, read, len(tc.data), "test n°%02d, wrong number of values read", n)
 		for i := range tc.data {
 			assert.Equal(t, tc.data[i], read[i], "test n°%02d, value n°%d does not match", n, i)
 		}
@@ -200,7 +387,109 @@ func TestRequestLineInputRead(t *testing.T) {
 	c.Close()
 }
 
+func TestRequestLineInputReadMask(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+	l := gpio.NewHandleRequest([]int{0, 1, 2}, gpio.HandleRequestInput)
+	c.RequestLines(l)
+
+	assert.NoError(t, mockChip.Write([]int{1, 0, 1}), "unable to write using mockChip")
+	bits, err := l.ReadMask()
+	assert.NoError(t, err, "unable to read mask from input line")
+	assert.Equal(t, uint64(0x5), bits)
+
+	values := make([]int, 2)
+	n, err := l.ReadInto(values)
+	assert.NoError(t, err, "unable to read into from input line")
+	assert.Equal(t, 2, n, "ReadInto should be limited to the length of values")
+	assert.Equal(t, []int{1, 0}, values)
+
+	allocs := testing.AllocsPerRun(100, func() { l.ReadInto(values) })
+	assert.Equal(t, float64(0), allocs, "ReadInto should not allocate")
+
+	l.Close()
+	c.Close()
+}
+
+func TestRequestLineOutputWriteMask(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+	l := gpio.NewHandleRequest([]int{0, 1, 2}, gpio.HandleRequestOutput).WithDefaults([]int{1, 1, 1})
+	c.RequestLines(l)
+
+	assert.NoError(t, l.WriteMask(0x0, 0x2), "unable to write mask to output line")
+	mockread, err := mockChip.Read()
+	assert.NoError(t, err, "unable to read using mockChip")
+	assert.Equal(t, []int{1, 0, 1}, mockread[:3], "only the line in mask should change")
+
+	assert.NoError(t, l.WriteMask(0x2, 0x3), "unable to write mask to output line")
+	mockread, err = mockChip.Read()
+	assert.NoError(t, err, "unable to read using mockChip")
+	assert.Equal(t, []int{0, 1, 1}, mockread[:3], "only the lines in mask should change")
+
+	l.Close()
+	c.Close()
+}
+
+func TestRequestLineOutputSetValues(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+	l := gpio.NewHandleRequest([]int{2, 3, 4, 5}, gpio.HandleRequestOutput).WithDefaults([]int{1, 0, 1, 0})
+	c.RequestLines(l)
+
+	assert.NoError(t, l.SetValue(3, 1), "unable to set value of output line")
+	mockread, err := mockChip.Read()
+	assert.NoError(t, err, "unable to read using mockChip")
+	assert.Equal(t, []int{1, 1, 1, 0}, mockread[2:6], "only line 3 should change")
+
+	assert.NoError(t, l.SetValues(map[int]int{2: 0, 5: 1}), "unable to set values of output lines")
+	mockread, err = mockChip.Read()
+	assert.NoError(t, err, "unable to read using mockChip")
+	assert.Equal(t, []int{0, 1, 1, 1}, mockread[2:6], "only lines 2 and 5 should change")
+
+	err = l.SetValue(0, 1)
+	assert.True(t, errors.Is(err, gpio.ErrInvalidOffset), "setting a line not requested should fail")
+
+	l.Close()
+	c.Close()
+}
+
+func TestHandleRequestValuesMask(t *testing.T) {
+	chip := newFakeChip(t, "fake-A", 4)
+
+	out := gpio.NewHandleRequest([]int{0, 1, 2}, gpio.HandleRequestOutput).WithDefaults([]int{1, 1, 1})
+	require.Nil(t, chip.RequestLines(out))
+	defer out.Close()
+	assert.Nil(t, out.WriteMask(0x0, 0x2))
+	for offset, expected := range []int{1, 0, 1} {
+		level, _ := chip.Level(offset)
+		assert.Equal(t, expected, level, "line %d", offset)
+	}
+
+	assert.Nil(t, out.SetValues(map[int]int{0: 0, 2: 0}))
+	assert.Nil(t, out.SetValue(1, 1))
+	for offset, expected := range []int{0, 1, 0} {
+		level, _ := chip.Level(offset)
+		assert.Equal(t, expected, level, "line %d", offset)
+	}
+	assert.True(t, errors.Is(out.SetValue(3, 1), gpio.ErrInvalidOffset))
+
+	in := gpio.NewHandleRequest([]int{3}, gpio.HandleRequestInput)
+	require.Nil(t, chip.RequestLines(in))
+	defer in.Close()
+	chip.SetLevel(3, 1)
+	bits, err := in.ReadMask()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), bits)
+
+	values := make([]int, 1)
+	allocs := testing.AllocsPerRun(100, func() { in.ReadInto(values) })
+	assert.Equal(t, []int{1}, values)
+	assert.Equal(t, float64(0), allocs)
+}
+
 func TestRequestLineOutputWrite(t *testing.T) {
+	requireMockup(t)
 	testCases := []struct {
 		data []int
 	}{
@@ -238,6 +527,7 @@ func TestRequestLineOutputWrite(t *testing.T) {
 }
 
 func TestEventLine(t *testing.T) {
+	requireMockup(t)
 	done := make(chan struct{}, 1)
 	line := 0
 
@@ -253,6 +543,40 @@ func TestEventLine(t *testing.T) {
 	}
 }
 
+func TestEventLineDebounce(t *testing.T) {
+	requireMockup(t)
+	done := make(chan struct{}, 1)
+	line := 1
+
+	mockChip.Write([]int{0, 0})
+	go func() {
+		c := newChip(t)
+
+		watcher, err := gpio.NewLineWatcher()
+		assert.NoError(t, err, "unable to create LineWatcher")
+
+		err = watcher.Add(c, line, gpio.BothEdges, "testEventLineDebounce", gpio.WithDebounce(10*time.Millisecond))
+		assert.NoError(t, err, "unable to add debounced event to the LineWatcher")
+
+		event, err := watcher.Wait()
+		assert.NoError(t, err, "unable to Wait on LineWatcher")
+		assert.True(t, event.IsRising(), "trapped event is not of expected type")
+
+		watcher.Close()
+		c.Close()
+		done <- struct{}{}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	mockChip.Write([]int{0, 1})
+
+	select {
+	case <-done:
+		break
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "LineWatcher with debounce did not finished before timeout")
+	}
+}
+
 func testEventLineWait(t *testing.T, line int, done chan struct{}) {
 	c := newChip(t)
 
@@ -265,6 +589,10 @@ func testEventLineWait(t *testing.T, line int, done chan struct{}) {
 	event, err := watcher.Wait()
 	assert.NoError(t, err, "unable to Wait on LineWatcher")
 	assert.True(t, event.IsRising(), "trapped event is not of expected type")
+	assert.Equal(t, mockChip.Name, event.Chip, "wrong chip for trapped event")
+	assert.Equal(t, line, event.Offset, "wrong line offset for trapped event")
+	assert.Equal(t, "testEventLineWait", event.Consumer, "wrong consumer for trapped event")
+	assert.Equal(t, uint32(1), event.LineSeqno, "wrong sequence number for trapped event")
 
 	err = watcher.Close()
 	assert.NoErrorf(t, err, "error while closing LineWatcher")
@@ -272,3 +600,200 @@ func testEventLineWait(t *testing.T, line int, done chan struct{}) {
 
 	done <- struct{}{}
 }
+
+func TestLineWatcherDebounce(t *testing.T) {
+	var now uint64
+	chip := newFakeChip(t, "fake-A", 4).WithClock(func() uint64 { return now })
+
+	watcher, err := gpio.NewLineWatcher()
+	require.Nil(t, err)
+	defer watcher.Close()
+
+	require.Nil(t, watcher.Add(chip, 0, gpio.RisingEdge, "rising"))
+	require.Nil(t, watcher.Add(chip, 1, gpio.BothEdges, "debounced", gpio.WithDebounce(time.Millisecond)))
+	require.Nil(t, watcher.Add(chip, 2, gpio.BothEdges, "glitch", gpio.WithDebounce(time.Millisecond)))
+
+	now = uint64(time.Second)
+	chip.SetLevel(0, 1)
+	chip.SetLevel(0, 0) // falling edge not requested
+	chip.SetLevel(1, 1)
+	chip.SetLevel(2, 1)
+	now += uint64(100 * time.Microsecond)
+	chip.SetLevel(1, 0) // bounce
+	chip.SetLevel(2, 0) // back to the previous level before the end of the period
+	now += uint64(100 * time.Microsecond)
+	chip.SetLevel(1, 1)
+	now += uint64(2 * time.Millisecond)
+	chip.SetLevel(1, 0)
+	now += uint64(100 * time.Microsecond)
+	chip.SetLevel(1, 1) // bounce
+	now += uint64(100 * time.Microsecond)
+	chip.SetLevel(1, 0)
+	now += uint64(2 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	events := make(map[int][]gpio.Event)
+	for {
+		event, err := watcher.WaitContext(ctx)
+		if err != nil {
+			assert.Equal(t, context.DeadlineExceeded, err)
+			break
+		}
+		events[event.Offset] = append(events[event.Offset], event)
+	}
+
+	require.Len(t, events[0], 1)
+	assert.True(t, events[0][0].IsRising())
+	assert.Empty(t, events[2], "glitch not dropped")
+
+	// one edge per change of level, reported once the line is stable
+	require.Len(t, events[1], 2)
+	assert.True(t, events[1][0].IsRising())
+	assert.Equal(t, uint64(time.Second+200*time.Microsecond+time.Millisecond), events[1][0].Timestamp)
+	assertEdges(t, chip, 1, events[1])
+}
+
+func TestLineWatcherDebounceTimer(t *testing.T) {
+	chip := newFakeChip(t, "fake-A", 4)
+
+	watcher, err := gpio.NewLineWatcher()
+	require.Nil(t, err)
+	defer watcher.Close()
+	require.Nil(t, watcher.Add(chip, 1, gpio.BothEdges, "debounced", gpio.WithDebounce(10*time.Millisecond)))
+
+	var events []gpio.Event
+	for _, level := range []int{1, 0, 1, 0, 1, 0} {
+		chip.SetLevel(1, level)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		event, err := watcher.WaitContext(ctx)
+		cancel()
+		if err == nil {
+			events = append(events, event)
+		}
+	}
+	chip.SetLevel(1, 1)
+	assert.Empty(t, events, "edges reported while the line bounces")
+
+	// no edge follows the last one, the timer of the debouncer wakes up the watcher
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	event, err := watcher.WaitContext(ctx)
+	require.Nil(t, err)
+	events = append(events, event)
+	assertEdges(t, chip, 1, events)
+}
+
+func TestEventLineClock(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+	defer c.Close()
+
+	watcher, err := gpio.NewLineWatcher()
+	assert.NoError(t, err, "unable to create a LineWatcher")
+	defer watcher.Close()
+
+	line := 3
+	mockChip.Write([]int{0, 0, 0, 0})
+	err = watcher.Add(c, line, gpio.RisingEdge, "testEventLineClock", gpio.WithEventClock(gpio.ClockRealtime))
+	if errors.Is(err, gpio.ErrUnsupportedByKernel) {
+		t.Skip("selecting the event clock requires the v2 API")
+	}
+	assert.NoError(t, err, "unable to add line with realtime clock")
+
+	before := time.Now()
+	mockChip.Write([]int{0, 0, 0, 1})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	event, err := watcher.WaitContext(ctx)
+	assert.NoError(t, err, "no event received")
+	assert.Equal(t, gpio.ClockRealtime, event.Clock)
+	assert.WithinDuration(t, before, event.Time(), time.Second, "realtime timestamp should be close to the wall clock")
+}
+
+func TestLineWatcherContext(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+
+	watcher, err := gpio.NewLineWatcher()
+	assert.NoError(t, err, "unable to create LineWatcher")
+	err = watcher.Add(c, 2, gpio.BothEdges, "testLineWatcherContext")
+	assert.NoError(t, err, "unable to add event to the LineWatcher")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = watcher.WaitContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "WaitContext should return when the context is done")
+	cancel()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	err = watcher.RunContext(ctx, func(gpio.Event) {})
+	assert.Equal(t, context.Canceled, err, "RunContext should return when the context is cancelled")
+
+	watcher.Close()
+	c.Close()
+}
+
+func TestLineWatcherStop(t *testing.T) {
+	requireMockup(t)
+	watcher, err := gpio.NewLineWatcher()
+	assert.NoError(t, err, "unable to create LineWatcher")
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		watcher.Stop()
+	}()
+	assert.NoError(t, watcher.WaitForEver(func(gpio.Event) {}), "WaitForEver should return nil when stopped")
+
+	_, err = watcher.Wait()
+	assert.Equal(t, gpio.ErrWatcherStopped, err, "Wait on a stopped LineWatcher should fail")
+
+	assert.NoError(t, watcher.Close(), "error while closing LineWatcher")
+}
+
+func TestLineWatcherAddRemove(t *testing.T) {
+	requireMockup(t)
+	mockChip.Write([]int{0, 0, 0, 0, 0, 0, 0})
+	c := newChip(t)
+
+	watcher, err := gpio.NewLineWatcher()
+	assert.NoError(t, err, "unable to create LineWatcher")
+
+	received := make(chan gpio.Event, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- watcher.WaitForEver(func(evd gpio.Event) { received <- evd })
+	}()
+
+	// lines added while waiting
+	assert.NoError(t, watcher.Add(c, 5, gpio.RisingEdge, "testLineWatcherAddRemove"), "unable to add line 5")
+	assert.NoError(t, watcher.Add(c, 4, gpio.FallingEdge, "testLineWatcherAddRemove"), "unable to add line 4")
+	assert.Equal(t, []gpio.WatchedLine{
+		{Chip: mockChip.Name, Offset: 4, Flags: gpio.FallingEdge, Consumer: "testLineWatcherAddRemove"},
+		{Chip: mockChip.Name, Offset: 5, Flags: gpio.RisingEdge, Consumer: "testLineWatcherAddRemove"},
+	}, watcher.Watched(), "wrong list of watched lines")
+
+	mockChip.Write([]int{0, 0, 0, 0, 0, 1})
+	select {
+	case event := <-received:
+		assert.Equal(t, 5, event.Offset, "wrong line offset for trapped event")
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "event on a line added while waiting not received before timeout")
+	}
+
+	// lines removed while waiting
+	assert.NoError(t, watcher.Remove(c, 4), "unable to remove line 4")
+	assert.Equal(t, gpio.ErrLineNotWatched, watcher.Remove(c, 4), "removing a line not watched should fail")
+	assert.Len(t, watcher.Watched(), 1, "wrong number of watched lines")
+	li, err := c.LineInfo(4)
+	assert.NoError(t, err, "unable to request line info")
+	assert.False(t, li.IsKernel(), "removed line should be released")
+
+	watcher.Stop()
+	assert.NoError(t, <-done, "WaitForEver should return nil when stopped")
+	watcher.Close()
+	c.Close()
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// EventClock is the clock used by the kernel to timestamp the edge events.
+type EventClock int
+
+// Event clocks.
+const (
+	ClockMonotonic EventClock = iota // CLOCK_MONOTONIC, the default
+	ClockRealtime                    // CLOCK_REALTIME, requires the v2 API and Linux 5.11
+	ClockHTE                         // hardware timestamp engine, requires the v2 API, Linux 5.19 and a kernel built with HTE support
+)
+
+// String returns the name of the clock.
+func (c EventClock) String() string {
+	switch c {
+	case ClockRealtime:
+		return "realtime"
+	case ClockHTE:
+		return "hte"
+	}
+	return "monotonic"
+}
+
+// flagsV2 returns the v2 line flags selecting the clock.
+func (c EventClock) flagsV2() uint64 {
+	switch c {
+	case ClockRealtime:
+		return lineFlagV2ClockRealtime
+	case ClockHTE:
+		return lineFlagV2ClockHTE
+	}
+	return 0
+}
+
+// unsupported returns ErrUnsupportedByKernel instead of the EINVAL with which a kernel
+// older than the clock rejects a request selecting it.
+func (c EventClock) unsupported(err error) error {
+	switch c {
+	case ClockRealtime:
+		return unsupportedBefore(err, 5, 11)
+	case ClockHTE:
+		return unsupportedBefore(err, 5, 19)
+	}
+	return err
+}
+
+// WithEventClock selects the clock used to timestamp the events of a watched line.
+// Clocks other than ClockMonotonic require the v2 API and a kernel knowing them, otherwise Add returns ErrUnsupportedByKernel.
+func WithEventClock(clock EventClock) WatchOption {
+	return func(r *EventRequest) {
+		r.Clock = clock
+	}
+}
+
+// WithEventClock selects the clock used to timestamp the edge events of a prepared HandleRequest.
+// Clocks other than ClockMonotonic require the v2 API and a kernel knowing them, otherwise RequestLines returns ErrUnsupportedByKernel.
+func (hr *HandleRequest) WithEventClock(clock EventClock) *HandleRequest {
+	hr.clock = clock
+	return hr
+}
+
+// Time returns the time at which the event occurred.
+// CLOCK_MONOTONIC timestamps are converted using the current offset between the wall clock and CLOCK_MONOTONIC.
+// The timestamps of a hardware timestamp engine count in the time base of the engine,
+// they cannot be converted and the zero time is returned, Timestamp being left to the caller.
+func (e Event) Time() time.Time {
+	switch e.Clock {
+	case ClockRealtime:
+		return time.Unix(0, int64(e.Timestamp))
+	case ClockHTE:
+		return time.Time{}
+	}
+	return time.Now().Add(-e.Since())
+}
+
+// Since returns the time elapsed since the event occurred, or 0 for the timestamps of a hardware timestamp engine.
+func (e Event) Since() time.Duration {
+	switch e.Clock {
+	case ClockRealtime:
+		return time.Since(e.Time())
+	case ClockHTE:
+		return 0
+	}
+	return time.Duration(monotonicNow() - int64(e.Timestamp))
+}
+
+// monotonicNow returns the CLOCK_MONOTONIC time in nanoseconds.
+func monotonicNow() int64 {
+	var ts unix.Timespec
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	return ts.Nano()
+}
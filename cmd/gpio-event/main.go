@@ -7,13 +7,21 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	gpio "github.com/vinymeuh/chardevgpio"
 )
 
 func printEventData(evd gpio.Event) {
-	fmt.Printf("[%d.%09d]", evd.Timestamp/1000000000, evd.Timestamp%1000000000)
+	stamp := evd.Time().Format(time.RFC3339Nano)
+	if evd.Clock == gpio.ClockHTE {
+		stamp = strconv.FormatUint(evd.Timestamp, 10)
+	}
+	fmt.Printf("[%s] %s line %d #%d", stamp, evd.Chip, evd.Offset, evd.LineSeqno)
 	if evd.IsRising() {
 		fmt.Fprintln(os.Stdout, " RISING")
 	}
@@ -25,8 +33,34 @@ func printEventData(evd gpio.Event) {
 func main() {
 	devicePath := flag.String("device", "/dev/gpiochip0", "GPIO device path")
 	lineOffset := flag.Int("line", 20, "input line number")
+	lineName := flag.String("name", "", "input line name, overrides device and line")
+	debounce := flag.Duration("debounce", 0, "debounce period")
+	clockName := flag.String("clock", "monotonic", "event clock: monotonic, realtime or hte")
+	poll := flag.Duration("poll", 0, "sample the line at this interval, for chips without interrupt support")
 	flag.Parse()
 
+	var clock gpio.EventClock
+	switch *clockName {
+	case "monotonic":
+		clock = gpio.ClockMonotonic
+	case "realtime":
+		clock = gpio.ClockRealtime
+	case "hte":
+		clock = gpio.ClockHTE
+	default:
+		fmt.Fprintf(os.Stderr, "unknown clock %s\n", *clockName)
+		os.Exit(1)
+	}
+
+	if *lineName != "" {
+		var err error
+		*devicePath, *lineOffset, err = gpio.FindLine(*lineName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "chardevgpio.FindLine: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
 	// Open the chip
 	chip, err := gpio.NewChip(*devicePath)
 	if err != nil {
@@ -35,19 +69,39 @@ func main() {
 	}
 	defer chip.Close()
 
-	// Create the LineWatcher
-	watcher, err := gpio.NewLineWatcher()
+	// Create the watcher
+	var watcher gpio.Watcher
+	if *poll > 0 {
+		watcher, err = gpio.NewPollingWatcher(*poll)
+	} else {
+		var lw *gpio.LineWatcher
+		lw, err = gpio.NewLineWatcher()
+		if err == nil {
+			lw.OnLostEvents(func(line gpio.WatchedLine, lost uint64) {
+				fmt.Fprintf(os.Stderr, "%s line %d: %d events lost\n", line.Chip, line.Offset, lost)
+			})
+		}
+		watcher = lw
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "chardevgpio.NewEventLineWatcher: %s\n", err)
 		os.Exit(1)
 	}
 	defer watcher.Close()
 
-	if err := watcher.Add(chip, *lineOffset, gpio.BothEdges, filepath.Base(os.Args[0])); err != nil {
+	if err := watcher.Add(chip, *lineOffset, gpio.BothEdges, filepath.Base(os.Args[0]), gpio.WithDebounce(*debounce), gpio.WithEventClock(clock)); err != nil {
 		fmt.Fprintf(os.Stderr, "watcher.AddEvent: %s\n", err)
 		os.Exit(1)
 	}
 
+	// stop watching on SIGINT or SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		watcher.Stop()
+	}()
+
 	err = watcher.WaitForEver(printEventData)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "watcher.WaitForEver: %s\n", err)
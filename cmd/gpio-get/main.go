@@ -15,8 +15,18 @@ import (
 func main() {
 	path := flag.String("device", "/dev/gpiochip0", "GPIO device path")
 	offset := flag.Int("line", 22, "line number")
+	name := flag.String("name", "", "line name, overrides device and line")
 	flag.Parse()
 
+	if *name != "" {
+		var err error
+		*path, *offset, err = gpio.FindLine(*name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	chip, err := gpio.NewChip(*path)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
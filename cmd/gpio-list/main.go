@@ -6,7 +6,6 @@ package main
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 
 	gpio "github.com/vinymeuh/chardevgpio"
 )
@@ -18,7 +17,14 @@ func printChipInfo(path string) {
 		os.Exit(1)
 	}
 	defer chip.Close()
-	fmt.Printf("file = %s, name = %s, label = %s, lines = %d\n", path, chip.Name(), chip.Label(), chip.Lines())
+	fmt.Printf("file = %s, name = %s, label = %s, lines = %d", path, chip.Name(), chip.Label(), chip.Lines())
+	if base, err := chip.Base(); err == nil {
+		fmt.Printf(", base = %d", base)
+	}
+	if driver, err := chip.Driver(); err == nil {
+		fmt.Printf(", driver = %s", driver)
+	}
+	fmt.Println()
 
 	for i := 0; i < chip.Lines(); i++ {
 		li, err := chip.LineInfo(i)
@@ -57,7 +63,11 @@ func printLineInfo(li gpio.LineInfo) {
 }
 
 func main() {
-	chips, _ := filepath.Glob("/dev/gpiochip*")
+	chips, err := gpio.ListChips()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	for _, chip := range chips {
 		printChipInfo(chip)
 	}
@@ -0,0 +1,38 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+)
+
+func main() {
+	monitor, err := gpio.NewChipMonitor()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer monitor.Close()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		monitor.Stop()
+	}()
+
+	err = monitor.RunContext(context.Background(), func(evd gpio.ChipEvent) {
+		fmt.Printf("%s %s, label = %s\n", evd.Path, evd.Op, evd.Label)
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
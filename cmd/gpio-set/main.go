@@ -16,10 +16,20 @@ import (
 func main() {
 	path := flag.String("device", "/dev/gpiochip0", "GPIO device path")
 	offset := flag.Int("line", 22, "line number")
+	name := flag.String("name", "", "line name, overrides device and line")
 	value := flag.Int("value", 1, "value to write (0/1)")
 	seconds := flag.Int("time", 60, "write hold time (seconds)")
 	flag.Parse()
 
+	if *name != "" {
+		var err error
+		*path, *offset, err = gpio.FindLine(*name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
 	chip, err := gpio.NewChip(*path)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -0,0 +1,138 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Debouncer filters the bounces of a line, for EventSource implementations debouncing in software.
+// As the kernel does with the v2 API, a change of level is held until the line has kept its new level
+// for the debounce period, and dropped if the line goes back to its previous level meanwhile:
+// whatever the bounces, the last change is reported once the line is stable.
+// Changes are tracked on both edges, only the requested ones being reported.
+//
+// Changes are recorded with Edge and reported by Settle. An EventSource waited for on a file descriptor
+// returns the one given by Watch instead, so that it becomes readable as well when a pending change settles.
+// A Debouncer is not safe for concurrent use.
+type Debouncer struct {
+	flags   EventRequestFlags
+	period  uint64 // in nanoseconds
+	level   int    // level last reported
+	next    int    // level pending, different from level
+	pending bool
+	changed uint64 // timestamp of the last change of the level
+
+	// epoll instance watching the file descriptor of the EventSource and a timer armed for the pending change,
+	// -1 if not watching
+	epfd    int
+	timerfd int
+	spec    unix.ItimerSpec
+	expired [8]byte
+}
+
+// NewDebouncer returns a Debouncer reporting the edges in flags of a line at level,
+// filtering the bounces shorter than period. Changes are reported at once if period is 0.
+func NewDebouncer(flags EventRequestFlags, period time.Duration, level int) *Debouncer {
+	return &Debouncer{flags: flags, period: uint64(period), level: level & 1, epfd: -1, timerfd: -1}
+}
+
+// Watch returns a file descriptor readable when one of the epoll events in events, as returned by
+// PollEventSource.PollEvents, is signaled on fd or when a pending change settles. It is to be returned
+// by EventSource.Fd instead of fd, the EventSource being watched for EPOLLIN. It is released by Close.
+func (d *Debouncer) Watch(fd int, events uint32) (int, error) {
+	var err error
+	if d.epfd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC); err != nil {
+		return -1, err
+	}
+	if d.timerfd, err = unix.TimerfdCreate(unix.CLOCK_MONOTONIC, unix.TFD_NONBLOCK|unix.TFD_CLOEXEC); err != nil {
+		d.Close()
+		return -1, err
+	}
+	// level-triggered, so that the epoll instance is readable as long as one of them is signaled
+	for _, ev := range []unix.EpollEvent{{Events: events, Fd: int32(fd)}, {Events: unix.EPOLLIN, Fd: int32(d.timerfd)}} {
+		if err := unix.EpollCtl(d.epfd, unix.EPOLL_CTL_ADD, int(ev.Fd), &ev); err != nil {
+			d.Close()
+			return -1, err
+		}
+	}
+	return d.epfd, nil
+}
+
+// Edge records a change of the level of the line at timestamp, in nanoseconds.
+// Going back to the level last reported cancels the pending change. If the pending change
+// has settled before timestamp, its event is returned, as Settle would have done.
+func (d *Debouncer) Edge(level int, timestamp uint64) (Event, bool) {
+	evd, ok := d.settle(timestamp)
+	level &= 1
+	if level == d.level {
+		d.pending = false
+	} else {
+		d.next, d.pending, d.changed = level, true, timestamp
+	}
+	return evd, ok
+}
+
+// Settle returns the event reporting the pending change if the line has kept its level for the debounce period
+// at now, in nanoseconds of the clock of the edges, and if its edge is requested. Only the Timestamp, the end
+// of the period, and the ID of the event are set. When watching, Settle must be called each time the file descriptor is readable,
+// once the edges available have been recorded: it arms the timer for the change still pending.
+func (d *Debouncer) Settle(now uint64) (Event, bool) {
+	if d.epfd >= 0 {
+		unix.Read(d.timerfd, d.expired[:])
+	}
+
+	evd, ok := d.settle(now)
+	if d.epfd >= 0 {
+		var remaining uint64 // zero disarms the timer
+		switch {
+		case !d.pending:
+		case now < d.changed:
+			remaining = d.period
+		default:
+			remaining = d.period - (now - d.changed)
+		}
+		d.spec.Value = unix.NsecToTimespec(int64(remaining))
+		unix.TimerfdSettime(d.timerfd, 0, &d.spec, nil)
+	}
+	return evd, ok
+}
+
+// settle makes the pending change the level reported if the line has kept its level for the period at now,
+// returning its event if its edge is requested.
+func (d *Debouncer) settle(now uint64) (Event, bool) {
+	if !d.pending || now < d.changed || now-d.changed < d.period {
+		return Event{}, false
+	}
+	d.level, d.pending = d.next, false
+	evd := Event{Timestamp: d.changed + d.period, ID: RisingEdgeEvent}
+	edge := RisingEdge
+	if d.level == 0 {
+		evd.ID, edge = FallingEdgeEvent, FallingEdge
+	}
+	return evd, d.flags&edge == edge
+}
+
+// Level returns the level of the line last reported.
+func (d *Debouncer) Level() int {
+	return d.level
+}
+
+// Close releases the file descriptor returned by Watch. Closing it again does nothing.
+func (d *Debouncer) Close() error {
+	var err error
+	if d.epfd >= 0 {
+		err = unix.Close(d.epfd)
+		d.epfd = -1
+	}
+	if d.timerfd >= 0 {
+		unix.Close(d.timerfd)
+		d.timerfd = -1
+	}
+	return err
+}
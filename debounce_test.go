@@ -0,0 +1,100 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestDebouncer(t *testing.T) {
+	d := NewDebouncer(BothEdges, 10, 0)
+
+	// a change is reported once the line has kept its level for the period
+	_, ok := d.Edge(1, 100)
+	assert.False(t, ok)
+	_, ok = d.Settle(109)
+	assert.False(t, ok, "reported before the end of the period")
+	evd, ok := d.Settle(110)
+	assert.True(t, ok)
+	assert.True(t, evd.IsRising())
+	assert.Equal(t, uint64(110), evd.Timestamp)
+	assert.Equal(t, 1, d.Level())
+
+	// a glitch is dropped
+	d.Edge(0, 200)
+	d.Edge(1, 203)
+	_, ok = d.Settle(300)
+	assert.False(t, ok, "glitch reported")
+
+	// the last change of a bounce is reported
+	d.Edge(0, 400)
+	d.Edge(1, 402)
+	d.Edge(0, 404)
+	_, ok = d.Settle(413)
+	assert.False(t, ok)
+	evd, ok = d.Settle(414)
+	assert.True(t, ok)
+	assert.True(t, evd.IsFalling())
+	assert.Equal(t, uint64(414), evd.Timestamp)
+
+	// a change settled before the next edge is returned by Edge
+	d.Edge(1, 500)
+	evd, ok = d.Edge(0, 520)
+	assert.True(t, ok)
+	assert.True(t, evd.IsRising())
+	assert.Equal(t, uint64(510), evd.Timestamp)
+	evd, ok = d.Settle(530)
+	assert.True(t, ok)
+	assert.True(t, evd.IsFalling())
+}
+
+func TestDebouncerEdges(t *testing.T) {
+	d := NewDebouncer(RisingEdge, 0, 1)
+
+	// without period, changes are reported at once
+	d.Edge(0, 100)
+	_, ok := d.Settle(100)
+	assert.False(t, ok, "falling edge not requested")
+	assert.Equal(t, 0, d.Level())
+	d.Edge(1, 200)
+	evd, ok := d.Settle(200)
+	assert.True(t, ok)
+	assert.True(t, evd.IsRising())
+	assert.Equal(t, uint64(200), evd.Timestamp)
+}
+
+func TestDebouncerWatch(t *testing.T) {
+	var fds [2]int
+	require.NoError(t, unix.Pipe2(fds[:], unix.O_CLOEXEC))
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+	_, err := unix.Write(fds[1], []byte{1})
+	require.NoError(t, err)
+
+	readable := func(fd int) bool {
+		pfd := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(pfd, 0)
+		require.NoError(t, err)
+		return n == 1
+	}
+
+	// like a sysfs value file, the pipe stays readable without signaling priority data
+	d := NewDebouncer(BothEdges, 10, 0)
+	fd, err := d.Watch(fds[0], unix.EPOLLPRI)
+	require.NoError(t, err)
+	assert.False(t, readable(fd), "watched for EPOLLIN")
+	assert.NoError(t, d.Close())
+
+	d = NewDebouncer(BothEdges, 10, 0)
+	fd, err = d.Watch(fds[0], unix.EPOLLIN)
+	require.NoError(t, err)
+	assert.True(t, readable(fd))
+	assert.NoError(t, d.Close())
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DevRoot is the directory where ListChips and the ChipMonitor look for the gpiochipN character devices.
+var DevRoot = "/dev"
+
+// chipsPattern matches the character devices of the GPIO chips in DevRoot.
+const chipsPattern = "gpiochip*"
+
+// ListChips returns the paths of the character devices of the GPIO chips, ordered by chip number.
+func ListChips() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(DevRoot, chipsPattern))
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, path := range matches {
+		fi, err := os.Stat(path)
+		if err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return chipNumber(paths[i]) < chipNumber(paths[j])
+	})
+	return paths, nil
+}
+
+// chipNumber returns the number of a chip from the path of its character device, -1 if there is none.
+func chipNumber(path string) int {
+	n, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "gpiochip"))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// OpenChipByLabel opens the first chip whose label matches, ErrChipNotFound is returned if there is none.
+func OpenChipByLabel(label string) (Chip, error) {
+	paths, err := ListChips()
+	if err != nil {
+		return Chip{}, err
+	}
+
+	var firstErr error
+	for _, path := range paths {
+		c, err := NewChip(path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if c.Label() == label {
+			return c, nil
+		}
+		c.Close()
+	}
+	if firstErr != nil {
+		return Chip{}, firstErr
+	}
+	return Chip{}, ErrChipNotFound
+}
+
+// FindLine searches every chip for a line whose name matches and returns the path of its chip and its offset.
+// ErrLineNotFound is returned if there is none.
+func FindLine(name string) (string, int, error) {
+	paths, err := ListChips()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var firstErr error
+	for _, path := range paths {
+		offset, err := findLineOnChip(path, name)
+		if err == nil {
+			return path, offset, nil
+		}
+		if err != ErrLineNotFound && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return "", 0, firstErr
+	}
+	return "", 0, ErrLineNotFound
+}
+
+// findLineOnChip returns the offset of the line named name on the chip at path.
+func findLineOnChip(path string, name string) (int, error) {
+	c, err := NewChip(path)
+	if err != nil {
+		return 0, err
+	}
+	defer c.Close()
+
+	for i := 0; i < c.Lines(); i++ {
+		li, err := c.LineInfo(i)
+		if err != nil {
+			return 0, err
+		}
+		if li.Name() == name {
+			return i, nil
+		}
+	}
+	return 0, ErrLineNotFound
+}
+
+// ErrChipNotFound is returned when no chip matches the searched label.
+var ErrChipNotFound = errors.New("chip not found")
+
+// ErrLineNotFound is returned when no line matches the searched name.
+var ErrLineNotFound = errors.New("line not found")
@@ -0,0 +1,77 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+)
+
+func TestListChips(t *testing.T) {
+	requireMockup(t)
+	paths, err := gpio.ListChips()
+	assert.NoError(t, err, "unable to list chips")
+	assert.Contains(t, paths, mockChip.Path, "mockChip not listed")
+}
+
+func TestOpenChipByLabel(t *testing.T) {
+	requireMockup(t)
+	c, err := gpio.OpenChipByLabel(mockChip.Label)
+	assert.NoError(t, err, "unable to open chip by label")
+	assert.Equal(t, mockChip.Name, c.Name(), "wrong chip opened")
+	c.Close()
+
+	_, err = gpio.OpenChipByLabel("does-not-exist")
+	assert.Equal(t, gpio.ErrChipNotFound, err)
+}
+
+func TestFindLine(t *testing.T) {
+	requireMockup(t)
+	path, offset, err := gpio.FindLine(fmt.Sprintf("%s-%d", mockChip.Label, 3))
+	assert.NoError(t, err, "unable to find line")
+	assert.Equal(t, mockChip.Path, path, "wrong chip path")
+	assert.Equal(t, 3, offset, "wrong line offset")
+
+	_, _, err = gpio.FindLine("does-not-exist")
+	assert.Equal(t, gpio.ErrLineNotFound, err)
+}
+
+func TestFindGPIO(t *testing.T) {
+	requireMockup(t)
+	root, err := ioutil.TempDir("", "sysfs")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	gpio.SysfsRoot = root
+	defer func() { gpio.SysfsRoot = "/sys" }()
+
+	dev := filepath.Join(root, "devices", "platform", "gpio-mockup")
+	require.NoError(t, os.MkdirAll(filepath.Join(dev, mockChip.Name), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "bus", "gpio", "devices"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join(dev, mockChip.Name), filepath.Join(root, "bus", "gpio", "devices", mockChip.Name)))
+	require.NoError(t, os.Symlink("../../../bus/platform/drivers/gpio-mockup", filepath.Join(dev, "driver")))
+	for base, label := range map[int]string{480: "other-bank", 496: mockChip.Label} {
+		dir := filepath.Join(dev, "gpio", fmt.Sprintf("gpiochip%d", base))
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "base"), []byte(fmt.Sprintf("%d\n", base)), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "label"), []byte(label+"\n"), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ngpio"), []byte(fmt.Sprintf("%d\n", mockChip.Lines)), 0644))
+	}
+
+	path, offset, err := gpio.FindGPIO(499)
+	assert.NoError(t, err)
+	assert.Equal(t, mockChip.Path, path)
+	assert.Equal(t, 3, offset)
+	_, _, err = gpio.FindGPIO(100)
+	assert.Equal(t, gpio.ErrLineNotFound, err)
+}
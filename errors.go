@@ -0,0 +1,110 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrLineBusy is returned when requesting a line already in use.
+var ErrLineBusy = errors.New("line busy")
+
+// ErrInvalidOffset is returned when an offset does not match a line of the chip.
+var ErrInvalidOffset = errors.New("invalid line offset")
+
+// ErrNotGPIOChip is returned when opening a file which is not a GPIO character device.
+var ErrNotGPIOChip = errors.New("not a GPIO chip")
+
+// ErrPermission is returned when the process is not allowed to access the chip or the lines.
+var ErrPermission = errors.New("permission denied")
+
+// ErrChipRemoved is returned when the device of the chip has been removed, like an unplugged USB expander.
+var ErrChipRemoved = errors.New("chip removed")
+
+// ErrTooManyLines is returned when requesting more lines, or giving more default values, than authorized.
+var ErrTooManyLines = fmt.Errorf("number of lines exceeds maximum authorized (%d)", handlesMax)
+
+// OpError is the error returned by the operations on chips and lines.
+//
+// Err is the underlying error, like a syscall.Errno returned by the kernel.
+// errors.Is also matches the sentinel errors ErrLineBusy, ErrNotGPIOChip, ErrPermission,
+// ErrChipRemoved and ErrUnsupportedByKernel from the errno, so that callers do not have to know them.
+// As the kernel rejects unknown ioctls with EINVAL, like invalid arguments, operations not supported
+// by the running kernel are recognized from its version and fail with ErrUnsupportedByKernel itself.
+type OpError struct {
+	Op      string // operation, like "request lines"
+	Chip    string // name of the chip, or its path when opening it
+	Offsets []int  // offsets of the lines concerned, if any
+	Err     error
+}
+
+func (e *OpError) Error() string {
+	s := e.Op
+	if e.Chip != "" {
+		s += " " + e.Chip
+	}
+	if len(e.Offsets) > 0 {
+		s += fmt.Sprintf(" %v", e.Offsets)
+	}
+	return s + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *OpError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the errno of the underlying error matches target.
+func (e *OpError) Is(target error) bool {
+	var errno syscall.Errno
+	if !errors.As(e.Err, &errno) {
+		return false
+	}
+
+	switch target {
+	case ErrLineBusy:
+		return errno == unix.EBUSY
+	case ErrPermission:
+		return errno == unix.EACCES || errno == unix.EPERM
+	case ErrChipRemoved:
+		return errno == unix.ENODEV
+	case ErrNotGPIOChip:
+		// an unknown ioctl on a file which is not a GPIO chip
+		return e.Op == opOpen && errno == unix.ENOTTY
+	case ErrUnsupportedByKernel:
+		// a feature the kernel has not been built with
+		return errno == unix.EOPNOTSUPP
+	}
+	return false
+}
+
+// Operations reported by OpError.
+const (
+	opOpen            = "open"
+	opLineInfo        = "line info"
+	opWatchLineInfo   = "watch line info"
+	opUnwatchLineInfo = "unwatch line info"
+	opRequestLines    = "request lines"
+	opRequestEvents   = "request events"
+	opRead            = "read"
+	opWrite           = "write"
+	opReconfigure     = "reconfigure"
+	opClose           = "close"
+)
+
+// checkOffsets returns ErrInvalidOffset if one of the offsets does not match a line of a chip having n lines.
+func checkOffsets(offsets []int, n int) error {
+	for _, offset := range offsets {
+		if offset < 0 || offset >= n {
+			return ErrInvalidOffset
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+)
+
+func TestOpErrorIs(t *testing.T) {
+	for _, tc := range []struct {
+		op      string
+		err     error
+		matches []error
+	}{
+		{"request lines", unix.EBUSY, []error{gpio.ErrLineBusy}},
+		{"open", unix.EACCES, []error{gpio.ErrPermission}},
+		{"request lines", unix.EPERM, []error{gpio.ErrPermission}},
+		{"read", unix.ENODEV, []error{gpio.ErrChipRemoved}},
+		{"open", unix.ENOTTY, []error{gpio.ErrNotGPIOChip}},
+		{"watch line info", unix.ENOTTY, nil},
+		{"request lines", unix.EINVAL, nil},
+		{"request events", unix.EOPNOTSUPP, []error{gpio.ErrUnsupportedByKernel}},
+		{"reconfigure", gpio.ErrUnsupportedByKernel, []error{gpio.ErrUnsupportedByKernel}},
+	} {
+		err := &gpio.OpError{Op: tc.op, Chip: "gpiochip0", Err: tc.err}
+		for _, target := range []error{gpio.ErrLineBusy, gpio.ErrPermission, gpio.ErrChipRemoved, gpio.ErrNotGPIOChip, gpio.ErrUnsupportedByKernel} {
+			expected := false
+			for _, match := range tc.matches {
+				expected = expected || match == target
+			}
+			assert.Equal(t, expected, errors.Is(err, target), "%s: %v is %v", tc.op, tc.err, target)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// OverflowPolicy defines what happens to an event when the channel returned by LineWatcher.Events is full.
+type OverflowPolicy int
+
+// Overflow policies.
+const (
+	OverflowBlock      OverflowPolicy = iota // wait for the receiver, no events are dropped
+	OverflowDropOldest                       // drop the oldest event of the channel to make room
+	OverflowDropNewest                       // drop the event being delivered
+)
+
+// defaultEventsBufferSize is the capacity of the channel returned by LineWatcher.Events when not set.
+const defaultEventsBufferSize = 64
+
+// EventsOption is an optional setting for the channel returned by LineWatcher.Events.
+type EventsOption func(*eventsOptions)
+
+type eventsOptions struct {
+	size     int
+	overflow OverflowPolicy
+}
+
+// WithBufferSize sets the capacity of the channel returned by LineWatcher.Events.
+func WithBufferSize(size int) EventsOption {
+	return func(o *eventsOptions) {
+		o.size = size
+	}
+}
+
+// WithOverflowPolicy sets what happens to events when the channel returned by LineWatcher.Events is full.
+func WithOverflowPolicy(policy OverflowPolicy) EventsOption {
+	return func(o *eventsOptions) {
+		o.overflow = policy
+	}
+}
+
+// eventsFeed feeds the channel returned by the Events method of the watchers.
+type eventsFeed struct {
+	dropped uint64 // events dropped, first field to be 64 bits aligned for atomic operations
+
+	mu  sync.Mutex
+	err error // error returned by the goroutine feeding the channel
+}
+
+// run returns a channel fed by a goroutine with the events passed to the handler of run.
+func (f *eventsFeed) run(ctx context.Context, run func(ctx context.Context, handler EventHandlerFunc) error, options []EventsOption) <-chan Event {
+	opts := eventsOptions{size: defaultEventsBufferSize, overflow: OverflowBlock}
+	for _, option := range options {
+		option(&opts)
+	}
+
+	ch := make(chan Event, opts.size)
+	go func() {
+		err := run(ctx, func(evd Event) {
+			f.deliver(ctx, ch, evd, opts.overflow)
+		})
+		f.mu.Lock()
+		f.err = err
+		f.mu.Unlock()
+		close(ch)
+	}()
+	return ch
+}
+
+// deliver sends an event on the channel, applying the overflow policy.
+func (f *eventsFeed) deliver(ctx context.Context, ch chan Event, evd Event, overflow OverflowPolicy) {
+	switch overflow {
+	case OverflowDropNewest:
+		select {
+		case ch <- evd:
+		default:
+			atomic.AddUint64(&f.dropped, 1)
+		}
+	case OverflowDropOldest:
+		for {
+			select {
+			case ch <- evd:
+				return
+			default:
+			}
+			select {
+			case <-ch:
+				atomic.AddUint64(&f.dropped, 1)
+			default:
+			}
+		}
+	default:
+		select {
+		case ch <- evd:
+		case <-ctx.Done():
+			atomic.AddUint64(&f.dropped, 1)
+		}
+	}
+}
+
+// droppedEvents returns the number of events dropped because the channel was full.
+func (f *eventsFeed) droppedEvents() uint64 {
+	return atomic.LoadUint64(&f.dropped)
+}
+
+// lastErr returns why the channel has been closed.
+func (f *eventsFeed) lastErr() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Events returns a channel fed with the events on the event lines by an internal goroutine.
+// The channel is closed when the LineWatcher is stopped or ctx is done, Err then returns the reason.
+// Events dropped because of the overflow policy are counted by Dropped.
+func (lw *LineWatcher) Events(ctx context.Context, options ...EventsOption) <-chan Event {
+	return lw.feed.run(ctx, lw.RunContext, options)
+}
+
+// Dropped returns the number of events dropped because the channel returned by Events was full.
+// Events dropped by the kernel are reported by OnLostEvents.
+func (lw *LineWatcher) Dropped() uint64 {
+	return lw.feed.droppedEvents()
+}
+
+// Err returns why the channel returned by Events has been closed: nil if the LineWatcher
+// has been stopped, the context error if the context is done or the error which occurred while waiting.
+func (lw *LineWatcher) Err() error {
+	return lw.feed.lastErr()
+}
+
+// LostEventsFunc is the type of the function called when events of a watched line have been lost.
+// line describes the line, its Lost field counting all the events lost so far, lost is the number of events just lost.
+type LostEventsFunc func(line WatchedLine, lost uint64)
+
+// OnLostEvents sets the function called when events of a watched line have been dropped by the kernel,
+// its FIFO being full because the events were not read fast enough.
+// Lost events are detected from the gaps in the sequence numbers of the events, which requires the v2 API:
+// with the v1 API, events dropped by the kernel cannot be detected.
+// The function is called by the waiting goroutine, before the events following the gap are delivered.
+func (lw *LineWatcher) OnLostEvents(fn LostEventsFunc) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.onLost = fn
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+)
+
+func TestLineWatcherEvents(t *testing.T) {
+	requireMockup(t)
+	mockChip.Write([]int{0, 0, 0, 0})
+	c := newChip(t)
+
+	watcher, err := gpio.NewLineWatcher()
+	assert.NoError(t, err, "unable to create LineWatcher")
+	err = watcher.Add(c, 3, gpio.RisingEdge, "testLineWatcherEvents")
+	assert.NoError(t, err, "unable to add event to the LineWatcher")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := watcher.Events(ctx)
+	mockChip.Write([]int{0, 0, 0, 1})
+
+	select {
+	case event := <-events:
+		assert.True(t, event.IsRising(), "received event is not of expected type")
+		assert.Equal(t, 3, event.Offset, "wrong line offset for received event")
+	case <-time.After(2 * time.Second):
+		assert.Fail(t, "no event received before timeout")
+	}
+
+	cancel()
+	_, ok := <-events
+	assert.False(t, ok, "events channel should be closed when the context is cancelled")
+	assert.Equal(t, context.Canceled, watcher.Err(), "wrong reason for closing the events channel")
+
+	watcher.Close()
+	c.Close()
+}
+
+func TestLineWatcherEventsOverflow(t *testing.T) {
+	requireMockup(t)
+	mockChip.Write([]int{0, 0, 0, 0})
+	c := newChip(t)
+
+	watcher, err := gpio.NewLineWatcher()
+	assert.NoError(t, err, "unable to create LineWatcher")
+	err = watcher.Add(c, 3, gpio.BothEdges, "testLineWatcherEventsOverflow")
+	assert.NoError(t, err, "unable to add event to the LineWatcher")
+
+	events := watcher.Events(context.Background(), gpio.WithBufferSize(1), gpio.WithOverflowPolicy(gpio.OverflowDropNewest))
+	for _, v := range []int{1, 0, 1, 0} {
+		mockChip.Write([]int{0, 0, 0, v})
+	}
+	time.Sleep(200 * time.Millisecond)
+
+	event := <-events
+	assert.Equal(t, uint32(1), event.LineSeqno, "the first event should have been kept")
+	assert.Equal(t, uint64(3), watcher.Dropped(), "wrong number of dropped events")
+
+	watcher.Stop()
+	for range events {
+	}
+	assert.NoError(t, watcher.Err(), "events channel closed by Stop should not report an error")
+
+	watcher.Close()
+	c.Close()
+}
+
+func TestLineWatcherWaitInProgress(t *testing.T) {
+	chip := newFakeChip(t, "fake-A", 4)
+
+	watcher, err := gpio.NewLineWatcher()
+	require.Nil(t, err)
+	defer watcher.Close()
+	require.Nil(t, watcher.Add(chip, 0, gpio.RisingEdge, "busy"))
+
+	running := make(chan error)
+	go func() {
+		running <- watcher.RunContext(context.Background(), func(gpio.Event) {})
+	}()
+
+	// a canceled context makes the waiting call return at once, unless another one is in progress
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Eventually(t, func() bool {
+		_, err := watcher.WaitContext(canceled)
+		return err == gpio.ErrWaitInProgress
+	}, time.Second, time.Millisecond)
+	_, ok := <-watcher.Events(context.Background())
+	assert.False(t, ok, "channel fed while RunContext waits")
+	assert.Equal(t, gpio.ErrWaitInProgress, watcher.Err())
+
+	require.Nil(t, watcher.Stop())
+	assert.Nil(t, <-running)
+	_, err = watcher.WaitContext(context.Background())
+	assert.Equal(t, gpio.ErrWatcherStopped, err, "waiting call rejected once the other one returned")
+}
+
+func TestLineWatcherEventClock(t *testing.T) {
+	chip := newFakeChip(t, "fake-A", 4)
+
+	watcher, err := gpio.NewLineWatcher()
+	require.Nil(t, err)
+	defer watcher.Close()
+
+	require.Nil(t, watcher.Add(chip, 0, gpio.RisingEdge, "monotonic"))
+	require.Nil(t, watcher.Add(chip, 1, gpio.RisingEdge, "realtime", gpio.WithEventClock(gpio.ClockRealtime)))
+	err = watcher.Add(chip, 2, gpio.RisingEdge, "hte", gpio.WithEventClock(gpio.ClockHTE))
+	assert.True(t, errors.Is(err, gpio.ErrUnsupportedByKernel))
+
+	before := time.Now()
+	chip.SetLevel(0, 1)
+	chip.SetLevel(1, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		event, err := watcher.WaitContext(ctx)
+		require.Nil(t, err)
+		switch event.Offset {
+		case 0:
+			assert.Equal(t, gpio.ClockMonotonic, event.Clock)
+		case 1:
+			assert.Equal(t, gpio.ClockRealtime, event.Clock)
+			assert.Equal(t, uint64(event.Time().UnixNano()), event.Timestamp)
+		}
+		assert.WithinDuration(t, before, event.Time(), 100*time.Millisecond)
+		assert.True(t, event.Since() >= 0)
+		assert.True(t, event.Since() <= time.Since(before))
+	}
+}
+
+func TestEventTimeHTE(t *testing.T) {
+	event := gpio.Event{Timestamp: 123456789, Clock: gpio.ClockHTE}
+	assert.True(t, event.Time().IsZero(), "timestamps of the engine are not converted")
+	assert.Equal(t, time.Duration(0), event.Since())
+}
+
+func TestLineWatcherLostEvents(t *testing.T) {
+	chip := newFakeChip(t, "fake-A", 4)
+
+	watcher, err := gpio.NewLineWatcher()
+	require.Nil(t, err)
+	defer watcher.Close()
+
+	var lost []uint64
+	watcher.OnLostEvents(func(line gpio.WatchedLine, n uint64) {
+		assert.Equal(t, 1, line.Offset)
+		assert.Equal(t, "lossy", line.Consumer)
+		lost = append(lost, n)
+	})
+	require.Nil(t, watcher.Add(chip, 1, gpio.RisingEdge, "lossy"))
+
+	// 20 rising edges while the FIFO holds 16 events
+	for i := 0; i < 20; i++ {
+		chip.SetLevel(1, 1)
+		chip.SetLevel(1, 0)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	event, err := watcher.WaitContext(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(5), event.LineSeqno)
+	assert.Equal(t, []uint64{4}, lost)
+	require.Len(t, watcher.Watched(), 1)
+	assert.Equal(t, uint64(4), watcher.Watched()[0].Lost)
+
+	for i := 0; i < 15; i++ {
+		_, err := watcher.WaitContext(ctx)
+		require.Nil(t, err)
+	}
+	chip.SetLevel(1, 1)
+	event, err = watcher.WaitContext(ctx)
+	require.Nil(t, err)
+	assert.Equal(t, uint32(21), event.LineSeqno)
+	assert.Equal(t, []uint64{4}, lost, "no more events lost")
+}
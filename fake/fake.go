@@ -0,0 +1,574 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+// Package fake provides an in-memory GPIO chip implementing chardevgpio.GPIOChip.
+//
+// It simulates lines, consumers, busy lines, pulls, edge events and timestamps in process
+// so that code using chardevgpio can be unit tested without the gpio-mockup kernel module.
+package fake
+
+import (
+	"sync"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+	"golang.org/x/sys/unix"
+)
+
+// Pull is the level taken by a line when nothing drives it.
+type Pull int
+
+// Pulls of a line, PullDown being the default.
+const (
+	PullDown Pull = iota
+	PullUp
+)
+
+// Chip is an in-memory GPIO chip.
+type Chip struct {
+	name      string
+	label     string
+	mu        sync.Mutex
+	lines     []*line
+	clock     func() uint64
+	closed    bool
+	unplugged bool
+}
+
+// line is the state of a line of a fake Chip.
+type line struct {
+	name     string
+	consumer string
+	used     bool
+	flags    gpio.HandleRequestFlag
+	pull     Pull
+	external int // level applied from outside the chip, -1 if none
+	driven   int // level driven by the chip when configured as output
+	source   *eventSource
+}
+
+// NewChip returns a fake Chip with the given number of lines, all of them being unused inputs.
+func NewChip(name string, label string, lines int) *Chip {
+	c := &Chip{name: name, label: label}
+	for i := 0; i < lines; i++ {
+		c.lines = append(c.lines, &line{flags: gpio.HandleRequestInput, external: -1})
+	}
+	return c
+}
+
+// WithClock sets the clock used to timestamp events, in nanoseconds.
+// Default is the clock selected by the request, as used by the kernel.
+func (c *Chip) WithClock(clock func() uint64) *Chip {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clock
+	return c
+}
+
+// Now implements chardevgpio.ClockedChip, returning the time set by WithClock if any.
+func (c *Chip) Now(clock gpio.EventClock) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now(clock)
+}
+
+// now returns the time in nanoseconds of the clock used to timestamp events.
+// Must be called with c.mu held.
+func (c *Chip) now(clock gpio.EventClock) uint64 {
+	if c.clock != nil {
+		return c.clock()
+	}
+	id := unix.CLOCK_MONOTONIC
+	if clock == gpio.ClockRealtime {
+		id = unix.CLOCK_REALTIME
+	}
+	var ts unix.Timespec
+	unix.ClockGettime(int32(id), &ts)
+	return uint64(ts.Nano())
+}
+
+// Name returns the name of the chip.
+func (c *Chip) Name() string {
+	return c.name
+}
+
+// Label returns the label of the chip.
+func (c *Chip) Label() string {
+	return c.label
+}
+
+// Lines returns the number of lines of the chip.
+func (c *Chip) Lines() int {
+	return len(c.lines)
+}
+
+// SetLineName sets the name of a line.
+func (c *Chip) SetLineName(offset int, name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, err := c.line(offset)
+	if err != nil {
+		return err
+	}
+	l.name = name
+	return nil
+}
+
+// LineInfo returns informations about the requested line.
+func (c *Chip) LineInfo(offset int) (gpio.LineInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return gpio.LineInfo{}, c.opError("line info", []int{offset}, gpio.ErrClosed)
+	}
+	if c.unplugged {
+		return gpio.LineInfo{}, c.opError("line info", []int{offset}, unix.ENODEV)
+	}
+	l, err := c.line(offset)
+	if err != nil {
+		return gpio.LineInfo{}, c.opError("line info", []int{offset}, err)
+	}
+	return gpio.NewLineInfo(offset, l.name, l.consumer, l.used, l.flags), nil
+}
+
+// RequestLines takes a prepared HandleRequest and returns it ready to work.
+// The error matches chardevgpio.ErrLineBusy if one of the lines is already in use.
+func (c *Chip) RequestLines(request *gpio.HandleRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offsets := request.Offsets()
+	if err := c.checkRequest(offsets, request.Err()); err != nil {
+		return c.opError("request lines", offsets, err)
+	}
+
+	for _, offset := range offsets {
+		l := c.lines[offset]
+		l.used = true
+		l.consumer = request.Consumer()
+	}
+	fl := &lines{chip: c, offsets: offsets}
+	fl.configure(request.LineConfigs(), request.Defaults())
+	request.SetDriver(c.name, fl)
+	return nil
+}
+
+// RequestEvents requests a line for edge detection.
+// The error matches chardevgpio.ErrLineBusy if the line is already in use.
+func (c *Chip) RequestEvents(request gpio.EventRequest) (gpio.EventSource, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offsets := []int{request.Offset}
+	if err := c.checkRequest(offsets, nil); err != nil {
+		return nil, c.opError("request events", offsets, err)
+	}
+	if request.Clock == gpio.ClockHTE {
+		// no hardware timestamp engine
+		return nil, c.opError("request events", offsets, unix.EOPNOTSUPP)
+	}
+
+	efd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		return nil, c.opError("request events", offsets, err)
+	}
+	l := c.lines[request.Offset]
+	l.flags = gpio.HandleRequestInput
+	es := &eventSource{
+		chip:      c,
+		offset:    request.Offset,
+		efd:       efd,
+		fd:        efd,
+		clock:     request.Clock,
+		debouncer: gpio.NewDebouncer(request.Flags, request.Debounce, l.level()),
+	}
+	if request.Debounce > 0 {
+		if es.fd, err = es.debouncer.Watch(efd, unix.EPOLLIN); err != nil {
+			unix.Close(efd)
+			return nil, c.opError("request events", offsets, err)
+		}
+	}
+	l.used = true
+	l.consumer = request.Consumer
+	l.source = es
+	return es, nil
+}
+
+// Close closes the chip, lines already requested remain usable
+// and the lines can still be driven from outside. Closing it again does nothing.
+func (c *Chip) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return nil
+}
+
+// Unplug simulates the removal of the device of the chip, as when an USB expander is unplugged.
+// Operations on the chip and on the lines already requested then fail with ENODEV,
+// matching chardevgpio.ErrChipRemoved, and the watchers of its event lines are woken up.
+// Lines still have to be released.
+func (c *Chip) Unplug() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.unplugged = true
+	for _, l := range c.lines {
+		if l.source != nil {
+			l.source.signal()
+		}
+	}
+}
+
+// SetLevel applies a level from outside the chip on a line, as would do an external device.
+// Changing the level of a line requested for edge detection generates an event.
+// A line configured as output ignores the external level, except when driven high in open drain.
+func (c *Chip) SetLevel(offset int, level int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, err := c.line(offset)
+	if err != nil {
+		return err
+	}
+	c.update(offset, func() {
+		l.external = level & 1
+	})
+	return nil
+}
+
+// Float stops applying a level from outside the chip on a line,
+// its level depends then on the bias configured on the line or on the pull of the chip.
+func (c *Chip) Float(offset int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, err := c.line(offset)
+	if err != nil {
+		return err
+	}
+	c.update(offset, func() {
+		l.external = -1
+	})
+	return nil
+}
+
+// SetPull sets the level taken by a line when nothing drives it and no bias is configured.
+func (c *Chip) SetPull(offset int, pull Pull) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, err := c.line(offset)
+	if err != nil {
+		return err
+	}
+	c.update(offset, func() {
+		l.pull = pull
+	})
+	return nil
+}
+
+// Level returns the physical level of a line, useful to check the values written on outputs.
+func (c *Chip) Level(offset int) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	l, err := c.line(offset)
+	if err != nil {
+		return 0, err
+	}
+	return l.level(), nil
+}
+
+// checkRequest returns the error preventing to request the lines at offsets, if any.
+// Must be called with c.mu held.
+func (c *Chip) checkRequest(offsets []int, err error) error {
+	if c.closed {
+		return gpio.ErrClosed
+	}
+	if c.unplugged {
+		return unix.ENODEV
+	}
+	if err != nil {
+		return err
+	}
+	for _, offset := range offsets {
+		l, err := c.line(offset)
+		if err != nil {
+			return err
+		}
+		if l.used {
+			return unix.EBUSY
+		}
+	}
+	return nil
+}
+
+// opError returns the chardevgpio.OpError for an operation on the chip.
+func (c *Chip) opError(op string, offsets []int, err error) error {
+	return &gpio.OpError{Op: op, Chip: c.name, Offsets: offsets, Err: err}
+}
+
+// line returns the line at offset, chardevgpio.ErrInvalidOffset if it does not exist.
+// Must be called with c.mu held.
+func (c *Chip) line(offset int) (*line, error) {
+	if offset < 0 || offset >= len(c.lines) {
+		return nil, gpio.ErrInvalidOffset
+	}
+	return c.lines[offset], nil
+}
+
+// update applies a change to the line at offset and generates the resulting edge event if any.
+// Must be called with c.mu held.
+func (c *Chip) update(offset int, change func()) {
+	l := c.lines[offset]
+	before := l.level()
+	change()
+	after := l.level()
+	if before == after || l.source == nil {
+		return
+	}
+
+	l.source.push(after, c.now(l.source.clock))
+}
+
+// level returns the physical level of the line.
+func (l *line) level() int {
+	if l.flags&gpio.HandleRequestOutput == gpio.HandleRequestOutput {
+		if !(l.flags&gpio.HandleRequestOpenDrain == gpio.HandleRequestOpenDrain && l.driven == 1) {
+			return l.driven
+		}
+	}
+	if l.external >= 0 {
+		return l.external
+	}
+	switch {
+	case l.flags&gpio.HandleRequestBiasPullUp == gpio.HandleRequestBiasPullUp:
+		return 1
+	case l.flags&gpio.HandleRequestBiasPullDown == gpio.HandleRequestBiasPullDown:
+		return 0
+	case l.pull == PullUp:
+		return 1
+	}
+	return 0
+}
+
+// activeLow returns 1 if the line is configured as active low, 0 otherwise.
+func (l *line) activeLow() int {
+	if l.flags&gpio.HandleRequestActiveLow == gpio.HandleRequestActiveLow {
+		return 1
+	}
+	return 0
+}
+
+// lines is the LineDriver of lines requested on a fake Chip.
+type lines struct {
+	chip    *Chip
+	offsets []int
+	closed  bool
+}
+
+// configure applies the configurations and the default values of the lines,
+// edge detection and debouncing being ignored.
+// Must be called with chip.mu held.
+func (fl *lines) configure(configs []gpio.LineConfig, defaults []int) {
+	for i, offset := range fl.offsets {
+		l := fl.chip.lines[offset]
+		flags := configs[i].Flags
+		fl.chip.update(offset, func() {
+			l.flags = flags
+			if flags&gpio.HandleRequestOutput == gpio.HandleRequestOutput {
+				var value int
+				if i < len(defaults) {
+					value = defaults[i] & 1
+				}
+				l.driven = value ^ l.activeLow()
+			}
+		})
+	}
+}
+
+// GetValues implements chardevgpio.LineDriver.
+func (fl *lines) GetValues(mask uint64) (uint64, error) {
+	fl.chip.mu.Lock()
+	defer fl.chip.mu.Unlock()
+
+	if fl.closed {
+		return 0, gpio.ErrClosed
+	}
+	if fl.chip.unplugged {
+		return 0, unix.ENODEV
+	}
+	var bits uint64
+	for i, offset := range fl.offsets {
+		l := fl.chip.lines[offset]
+		if l.level()^l.activeLow() == 1 {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits & mask, nil
+}
+
+// SetValues implements chardevgpio.LineDriver.
+func (fl *lines) SetValues(bits, mask uint64) error {
+	fl.chip.mu.Lock()
+	defer fl.chip.mu.Unlock()
+
+	if fl.closed {
+		return gpio.ErrClosed
+	}
+	if fl.chip.unplugged {
+		return unix.ENODEV
+	}
+	for i, offset := range fl.offsets {
+		if mask>>uint(i)&1 == 0 {
+			continue
+		}
+		l := fl.chip.lines[offset]
+		if l.flags&gpio.HandleRequestOutput != gpio.HandleRequestOutput {
+			return unix.EPERM
+		}
+		fl.chip.update(offset, func() {
+			l.driven = int(bits>>uint(i)&1) ^ l.activeLow()
+		})
+	}
+	return nil
+}
+
+// Reconfigure implements chardevgpio.LineDriver.
+func (fl *lines) Reconfigure(flags gpio.HandleRequestFlag, defaults []int) error {
+	fl.chip.mu.Lock()
+	defer fl.chip.mu.Unlock()
+
+	if fl.closed {
+		return gpio.ErrClosed
+	}
+	if fl.chip.unplugged {
+		return unix.ENODEV
+	}
+	configs := make([]gpio.LineConfig, len(fl.offsets))
+	for i := range configs {
+		configs[i].Flags = flags
+	}
+	fl.configure(configs, defaults)
+	return nil
+}
+
+// Close implements chardevgpio.LineDriver, the lines keep their configuration once released.
+func (fl *lines) Close() error {
+	fl.chip.mu.Lock()
+	defer fl.chip.mu.Unlock()
+
+	if fl.closed {
+		return nil
+	}
+	fl.closed = true
+	for _, offset := range fl.offsets {
+		l := fl.chip.lines[offset]
+		l.used = false
+		l.consumer = ""
+	}
+	return nil
+}
+
+// eventSource is the EventSource of a line requested for edge detection on a fake Chip.
+// Events are queued in memory, an eventfd signaling that some are available.
+type eventSource struct {
+	chip      *Chip
+	offset    int
+	efd       int
+	fd        int // file descriptor returned by Fd, the one of the debouncer when debouncing
+	clock     gpio.EventClock
+	debouncer *gpio.Debouncer
+	lineSeqno uint32
+	queue     []gpio.Event
+	closed    bool
+}
+
+// fifoSize is the number of events queued by an eventSource, as by the kernel for an event line.
+const fifoSize = 16
+
+// push records an edge of the line, its event being queued once the line is stable.
+// Must be called with chip.mu held.
+func (es *eventSource) push(level int, timestamp uint64) {
+	es.enqueue(es.debouncer.Edge(level, timestamp))
+	es.enqueue(es.debouncer.Settle(timestamp))
+	es.signal() // when debouncing, ReadEvents arms the timer for the edge pending
+}
+
+// enqueue queues an event returned by the debouncer.
+// As the kernel does, the oldest event is dropped when the queue is full,
+// which leaves a gap in the sequence numbers of the events read.
+// Must be called with chip.mu held.
+func (es *eventSource) enqueue(evd gpio.Event, ok bool) {
+	if !ok {
+		return
+	}
+	es.lineSeqno++
+	evd.LineSeqno = es.lineSeqno
+	evd.Clock = es.clock
+	if len(es.queue) == fifoSize {
+		es.queue = es.queue[1:]
+	}
+	es.queue = append(es.queue, evd)
+}
+
+// signal makes the eventfd readable.
+func (es *eventSource) signal() {
+	var one = [8]byte{1}
+	unix.Write(es.efd, one[:])
+}
+
+// Fd implements chardevgpio.EventSource.
+func (es *eventSource) Fd() int {
+	return es.fd
+}
+
+// ReadEvents implements chardevgpio.EventSource.
+func (es *eventSource) ReadEvents() ([]gpio.Event, error) {
+	es.chip.mu.Lock()
+	defer es.chip.mu.Unlock()
+
+	if es.closed {
+		return nil, gpio.ErrClosed
+	}
+	var counter [8]byte
+	unix.Read(es.efd, counter[:])
+	if es.chip.unplugged {
+		return nil, unix.ENODEV
+	}
+	es.enqueue(es.debouncer.Settle(es.chip.now(es.clock)))
+	evds := es.queue
+	es.queue = nil
+	return evds, nil
+}
+
+// Close implements chardevgpio.EventSource, releasing the line.
+func (es *eventSource) Close() error {
+	es.chip.mu.Lock()
+	defer es.chip.mu.Unlock()
+
+	if es.closed {
+		return nil
+	}
+	es.closed = true
+	l := es.chip.lines[es.offset]
+	l.used = false
+	l.consumer = ""
+	l.source = nil
+	es.debouncer.Close()
+	return unix.Close(es.efd)
+}
+
+var (
+	_ gpio.GPIOChip    = (*Chip)(nil)
+	_ gpio.ClockedChip = (*Chip)(nil)
+	_ gpio.LineDriver  = (*lines)(nil)
+	_ gpio.EventSource = (*eventSource)(nil)
+)
@@ -0,0 +1,191 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package fake_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gpio "github.com/vinymeuh/chardevgpio"
+	"github.com/vinymeuh/chardevgpio/fake"
+)
+
+func TestChip(t *testing.T) {
+	chip := fake.NewChip("gpiochip9", "fake-A", 8)
+	defer chip.Close()
+
+	assert.Equal(t, "gpiochip9", chip.Name())
+	assert.Equal(t, "fake-A", chip.Label())
+	assert.Equal(t, 8, chip.Lines())
+
+	assert.Nil(t, chip.SetLineName(3, "LED"))
+	li, err := chip.LineInfo(3)
+	require.Nil(t, err)
+	assert.Equal(t, 3, li.Offset())
+	assert.Equal(t, "LED", li.Name())
+	assert.Equal(t, "", li.Consumer())
+	assert.True(t, li.IsInput())
+	assert.False(t, li.IsKernel())
+
+	_, err = chip.LineInfo(8)
+	assert.True(t, errors.Is(err, gpio.ErrInvalidOffset))
+
+	assert.Nil(t, chip.Close())
+	assert.Nil(t, chip.Close())
+	_, err = chip.LineInfo(3)
+	assert.True(t, errors.Is(err, gpio.ErrClosed))
+}
+
+func TestRequestLines(t *testing.T) {
+	chip := fake.NewChip("gpiochip9", "fake-A", 8)
+	defer chip.Close()
+
+	out := gpio.NewHandleRequest([]int{0, 1}, gpio.HandleRequestOutput).WithConsumer("out").WithDefaults([]int{1, 0})
+	require.Nil(t, chip.RequestLines(out))
+	defer out.Close()
+
+	li, err := chip.LineInfo(0)
+	require.Nil(t, err)
+	assert.True(t, li.IsKernel())
+	assert.True(t, li.IsOutput())
+	assert.Equal(t, "out", li.Consumer())
+
+	level, _ := chip.Level(0)
+	assert.Equal(t, 1, level)
+	level, _ = chip.Level(1)
+	assert.Equal(t, 0, level)
+
+	assert.Nil(t, out.Write(0, 1))
+	level, _ = chip.Level(0)
+	assert.Equal(t, 0, level)
+	level, _ = chip.Level(1)
+	assert.Equal(t, 1, level)
+
+	busy := gpio.NewHandleRequest([]int{1, 2}, gpio.HandleRequestInput)
+	err = chip.RequestLines(busy)
+	assert.True(t, errors.Is(err, gpio.ErrLineBusy))
+	var opErr *gpio.OpError
+	require.True(t, errors.As(err, &opErr))
+	assert.Equal(t, "request lines", opErr.Op)
+	assert.Equal(t, "gpiochip9", opErr.Chip)
+	assert.Equal(t, []int{1, 2}, opErr.Offsets)
+	li, _ = chip.LineInfo(2)
+	assert.False(t, li.IsKernel())
+
+	toomany := gpio.NewHandleRequest(make([]int, 65), gpio.HandleRequestInput)
+	assert.True(t, errors.Is(chip.RequestLines(toomany), gpio.ErrTooManyLines))
+
+	invalid := gpio.NewHandleRequest([]int{8}, gpio.HandleRequestInput)
+	assert.True(t, errors.Is(chip.RequestLines(invalid), gpio.ErrInvalidOffset))
+
+	assert.Nil(t, out.Close())
+	assert.Nil(t, out.Close())
+	assert.True(t, errors.Is(out.Write(1), gpio.ErrClosed))
+	li, _ = chip.LineInfo(0)
+	assert.False(t, li.IsKernel())
+	assert.Equal(t, "", li.Consumer())
+}
+
+func TestInputLevels(t *testing.T) {
+	chip := fake.NewChip("gpiochip9", "fake-A", 4)
+	defer chip.Close()
+
+	in := gpio.NewHandleRequest([]int{0, 1, 2}, gpio.HandleRequestInput)
+	require.Nil(t, chip.RequestLines(in))
+	defer in.Close()
+
+	_, values, err := in.Read()
+	require.Nil(t, err)
+	assert.Equal(t, []int{0, 0, 0}, values)
+
+	assert.Nil(t, chip.SetPull(1, fake.PullUp))
+	assert.Nil(t, chip.SetLevel(2, 1))
+	_, values, _ = in.Read()
+	assert.Equal(t, []int{0, 1, 1}, values)
+
+	assert.Nil(t, in.Reconfigure(gpio.HandleRequestInput|gpio.HandleRequestActiveLow|gpio.HandleRequestBiasPullUp, nil))
+	_, values, _ = in.Read()
+	assert.Equal(t, []int{0, 0, 0}, values)
+
+	assert.Nil(t, chip.SetLevel(0, 0))
+	assert.Nil(t, chip.Float(2))
+	_, values, _ = in.Read()
+	assert.Equal(t, []int{1, 0, 0}, values)
+}
+
+func TestLineWatcher(t *testing.T) {
+	var now uint64 = 1000
+	chip := fake.NewChip("gpiochip9", "fake-A", 4).WithClock(func() uint64 { return now })
+	defer chip.Close()
+
+	watcher, err := gpio.NewLineWatcher()
+	require.Nil(t, err)
+	defer watcher.Close()
+
+	require.Nil(t, watcher.Add(chip, 2, gpio.BothEdges, "watcher"))
+	assert.True(t, errors.Is(watcher.Add(chip, 2, gpio.BothEdges, "watcher"), gpio.ErrLineBusy))
+	li, _ := chip.LineInfo(2)
+	assert.True(t, li.IsKernel())
+	assert.Equal(t, "watcher", li.Consumer())
+
+	assert.Nil(t, chip.SetLevel(2, 1))
+	now += 500
+	assert.Nil(t, chip.SetLevel(2, 1)) // no edge
+	assert.Nil(t, chip.SetLevel(2, 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	event, err := watcher.WaitContext(ctx)
+	require.Nil(t, err)
+	assert.True(t, event.IsRising())
+	assert.Equal(t, uint64(1000), event.Timestamp)
+	assert.Equal(t, "gpiochip9", event.Chip)
+	assert.Equal(t, 2, event.Offset)
+	assert.Equal(t, "watcher", event.Consumer)
+	assert.Equal(t, uint32(1), event.LineSeqno)
+
+	event, err = watcher.WaitContext(ctx)
+	require.Nil(t, err)
+	assert.True(t, event.IsFalling())
+	assert.Equal(t, uint64(1500), event.Timestamp)
+	assert.Equal(t, uint32(2), event.LineSeqno)
+
+	assert.Nil(t, watcher.Remove(chip, 2))
+	li, _ = chip.LineInfo(2)
+	assert.False(t, li.IsKernel())
+}
+
+func TestUnplug(t *testing.T) {
+	chip := fake.NewChip("gpiochip9", "fake-A", 4)
+	defer chip.Close()
+
+	out := gpio.NewHandleRequest([]int{0}, gpio.HandleRequestOutput)
+	require.Nil(t, chip.RequestLines(out))
+	watcher, err := gpio.NewLineWatcher()
+	require.Nil(t, err)
+	defer watcher.Close()
+	require.Nil(t, watcher.Add(chip, 1, gpio.BothEdges, "watched"))
+
+	chip.Unplug()
+	assert.True(t, errors.Is(out.Write(1), gpio.ErrChipRemoved))
+	_, err = chip.LineInfo(2)
+	assert.True(t, errors.Is(err, gpio.ErrChipRemoved))
+	err = chip.RequestLines(gpio.NewHandleRequest([]int{2}, gpio.HandleRequestInput))
+	assert.True(t, errors.Is(err, gpio.ErrChipRemoved))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = watcher.WaitContext(ctx)
+	assert.True(t, errors.Is(err, gpio.ErrChipRemoved), "watcher woken up by the removal")
+	var opErr *gpio.OpError
+	require.True(t, errors.As(err, &opErr))
+	assert.Equal(t, []int{1}, opErr.Offsets)
+	assert.Nil(t, out.Close())
+}
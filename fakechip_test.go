@@ -0,0 +1,42 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+	"github.com/vinymeuh/chardevgpio/fake"
+)
+
+// fakeChips counts the fake chips created, so that each one gets its own name.
+var fakeChips int
+
+// newFakeChip creates a fake chip with a name of its own, closed at the end of the test.
+// Unlike the MockChip, it does not need the gpio-mockup kernel module.
+func newFakeChip(t *testing.T, label string, lines int) *fake.Chip {
+	t.Helper()
+	chip := fake.NewChip(fmt.Sprintf("gpiochip%d", 10+fakeChips), label, lines)
+	fakeChips++
+	t.Cleanup(func() { chip.Close() })
+	return chip
+}
+
+// assertEdges checks that the edges reported for a line requested for both edges alternate
+// and end on the level of the line.
+func assertEdges(t *testing.T, chip *fake.Chip, offset int, events []gpio.Event) {
+	t.Helper()
+	for i := 1; i < len(events); i++ {
+		assert.NotEqual(t, events[i-1].ID, events[i].ID, "edges %d and %d of the same kind", i-1, i)
+	}
+	if assert.NotEmpty(t, events) {
+		level, _ := chip.Level(offset)
+		assert.Equal(t, level == 1, events[len(events)-1].IsRising(), "last edge not ending on the level of the line")
+	}
+}
@@ -6,67 +6,57 @@
 package chardevgpio_test
 
 import (
-	"bytes"
-	"fmt"
-	"os"
-	"os/exec"
-	"strconv"
-	"strings"
+	"testing"
+
+	"github.com/vinymeuh/chardevgpio/gpiosim"
 )
 
-var mockChip MockChip
+var (
+	mockChip MockChip
+	mockErr  error // why the MockChip could not be initialized
+)
 
 func init() {
-	var err error
-	mockChip, err = NewMockChip()
-	if err != nil {
-		fmt.Printf("Unable to initialize MockChip: %s\n", err)
-		os.Exit(1)
+	mockChip, mockErr = NewMockChip()
+}
+
+// requireMockup skips the test when the gpio-mockup chip is not available,
+// so that tests based on fake chips or temporary directories still run.
+func requireMockup(t *testing.T) {
+	t.Helper()
+	if mockErr != nil {
+		t.Skipf("Unable to initialize MockChip: %s", mockErr)
 	}
 }
 
 type MockChip struct {
-	Path      string
-	Name      string
-	Label     string
-	Lines     int
-	debugPath string
+	Path  string
+	Name  string
+	Label string
+	Lines int
+	chip  *gpiosim.Chip
 }
 
 func NewMockChip() (MockChip, error) {
-	c := MockChip{
-		Path:      "/dev/gpiochip0",
-		Name:      "gpiochip0",
-		Label:     "gpio-mockup-A",
-		Lines:     10,
-		debugPath: "/sys/kernel/debug/gpio-mockup/gpiochip0",
-	}
-
-	_, err := os.Stat(c.debugPath)
+	chip, err := gpiosim.OpenMockup("gpiochip0")
 	if err != nil {
-		return c, err
+		return MockChip{}, err
 	}
 
-	return c, nil
-}
-
-func (m MockChip) linePath(i int) string {
-	return fmt.Sprintf("%s/%d", m.debugPath, i)
+	return MockChip{
+		Path:  chip.Path,
+		Name:  chip.Name,
+		Label: chip.Label,
+		Lines: chip.Lines,
+		chip:  chip,
+	}, nil
 }
 
 func (m MockChip) Read() ([]int, error) {
 	out := make([]int, m.Lines)
 	for i := 0; i < m.Lines; i++ {
-		cmdStr := fmt.Sprintf("cat %s", m.linePath(i))
-		cmd := exec.Command("sh", "-c", cmdStr)
-		var cmdOut bytes.Buffer
-		cmd.Stdout = &cmdOut
-		err := cmd.Run()
-		if err != nil {
-			return out, err
-		}
-
-		out[i], err = strconv.Atoi(strings.TrimSpace(cmdOut.String()))
+		var err error
+		out[i], err = m.chip.ReadOutput(i)
 		if err != nil {
 			return out, err
 		}
@@ -76,9 +66,7 @@ func (m MockChip) Read() ([]int, error) {
 
 func (m MockChip) Write(data []int) error {
 	for i := range data {
-		cmdStr := fmt.Sprintf("echo \"%d\" > %s", data[i], m.linePath(i))
-		cmd := exec.Command("sh", "-c", cmdStr)
-		err := cmd.Run()
+		err := m.chip.SetPull(i, data[i])
 		if err != nil {
 			return err
 		}
@@ -0,0 +1,272 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+// Package gpiosim is a test harness running code against real kernel GPIO chips simulated
+// by the gpio-sim or gpio-mockup kernel modules.
+//
+// gpio-sim chips are created and torn down through configfs, with any number of banks, line names and hogs.
+// gpio-mockup chips are created when the module is loaded, they can only be opened.
+// In both cases, the level applied from outside on a line is driven with SetPull and the level driven
+// by the chip on an output line is read with ReadOutput.
+package gpiosim
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+)
+
+// Directories used to create the simulated chips and to reach their lines.
+var (
+	ConfigfsRoot = "/sys/kernel/config/gpio-sim"   // configfs directory where the gpio-sim devices are created
+	SysfsRoot    = "/sys/devices/platform"         // platform devices, holding the sim_gpioN attributes of the gpio-sim lines
+	DebugfsRoot  = "/sys/kernel/debug/gpio-mockup" // debugfs directory holding the lines of the gpio-mockup chips
+	DevRoot      = "/dev"                          // directory of the character devices of the chips
+)
+
+// HogDirection is the direction of a line hogged by the kernel.
+type HogDirection string
+
+// Directions of a hogged line.
+const (
+	HogInput      HogDirection = "input"
+	HogOutputHigh HogDirection = "output-high"
+	HogOutputLow  HogDirection = "output-low"
+)
+
+// Hog describes a line requested by the kernel itself when the chip is created.
+type Hog struct {
+	Consumer  string
+	Direction HogDirection
+}
+
+// Bank describes a gpio-sim bank, each bank being exposed as a GPIO chip.
+type Bank struct {
+	Label string
+	Lines int
+	Names map[int]string // line names by offset
+	Hogs  map[int]Hog    // hogged lines by offset
+}
+
+// Sim is a gpio-sim device.
+type Sim struct {
+	dir   string // device directory in configfs
+	chips []*Chip
+}
+
+// Chip is a simulated GPIO chip.
+type Chip struct {
+	Name  string // name of the chip, like gpiochip0
+	Label string
+	Path  string // path of the character device
+	Lines int
+	lines string // directory holding one entry per line to drive it, from sysfs or debugfs
+	sim   bool   // true for a gpio-sim chip, false for a gpio-mockup one
+}
+
+// New creates a gpio-sim device named name with one chip per bank, and brings it live.
+func New(name string, banks ...Bank) (*Sim, error) {
+	s := &Sim{dir: filepath.Join(ConfigfsRoot, name)}
+	if err := os.Mkdir(s.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := s.configure(banks); err != nil {
+		s.remove()
+		return nil, err
+	}
+	if err := writeFile(filepath.Join(s.dir, "live"), "1"); err != nil {
+		s.remove()
+		return nil, err
+	}
+
+	devName, err := readFile(filepath.Join(s.dir, "dev_name"))
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	for i := range banks {
+		chipName, err := readFile(filepath.Join(s.bankDir(i), "chip_name"))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		c := &Chip{
+			Name:  chipName,
+			Path:  filepath.Join(DevRoot, chipName),
+			lines: filepath.Join(SysfsRoot, devName, chipName),
+			sim:   true,
+		}
+		if err := c.readInfo(); err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.chips = append(s.chips, c)
+	}
+	return s, nil
+}
+
+// configure creates the configfs entries of the banks.
+func (s *Sim) configure(banks []Bank) error {
+	for i, bank := range banks {
+		dir := s.bankDir(i)
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(dir, "num_lines"), strconv.Itoa(bank.Lines)); err != nil {
+			return err
+		}
+		if bank.Label != "" {
+			if err := writeFile(filepath.Join(dir, "label"), bank.Label); err != nil {
+				return err
+			}
+		}
+
+		for offset := 0; offset < bank.Lines; offset++ {
+			name, named := bank.Names[offset]
+			hog, hogged := bank.Hogs[offset]
+			if !named && !hogged {
+				continue
+			}
+			line := filepath.Join(dir, fmt.Sprintf("line%d", offset))
+			if err := os.Mkdir(line, 0755); err != nil {
+				return err
+			}
+			if named {
+				if err := writeFile(filepath.Join(line, "name"), name); err != nil {
+					return err
+				}
+			}
+			if hogged {
+				if err := os.Mkdir(filepath.Join(line, "hog"), 0755); err != nil {
+					return err
+				}
+				if err := writeFile(filepath.Join(line, "hog", "name"), hog.Consumer); err != nil {
+					return err
+				}
+				if err := writeFile(filepath.Join(line, "hog", "direction"), string(hog.Direction)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// bankDir returns the configfs directory of the i-th bank.
+func (s *Sim) bankDir(i int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("bank%d", i))
+}
+
+// Chips returns the chips of the device, in the order of the banks.
+func (s *Sim) Chips() []*Chip {
+	return s.chips
+}
+
+// Close brings the device down and removes it from configfs.
+func (s *Sim) Close() error {
+	if err := writeFile(filepath.Join(s.dir, "live"), "0"); err != nil {
+		return err
+	}
+	return s.remove()
+}
+
+// remove removes the configfs entries of the device, children first as configfs does not allow
+// to remove a non empty directory.
+func (s *Sim) remove() error {
+	var dirs []string
+	filepath.Walk(s.dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+
+	var err error
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if e := os.Remove(dirs[i]); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// OpenMockup returns the gpio-mockup chip named name, like gpiochip0.
+func OpenMockup(name string) (*Chip, error) {
+	c := &Chip{
+		Name:  name,
+		Path:  filepath.Join(DevRoot, name),
+		lines: filepath.Join(DebugfsRoot, name),
+	}
+	if _, err := os.Stat(c.lines); err != nil {
+		return nil, err
+	}
+	if err := c.readInfo(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readInfo sets the label and the number of lines of the chip from its character device.
+func (c *Chip) readInfo() error {
+	chip, err := gpio.NewChip(c.Path)
+	if err != nil {
+		return err
+	}
+	defer chip.Close()
+	c.Label = chip.Label()
+	c.Lines = chip.Lines()
+	return nil
+}
+
+// SetPull drives the level of a line from outside the chip, 0 for pull-down and 1 for pull-up.
+// Changing the level of a line requested for edge detection generates an event.
+func (c *Chip) SetPull(offset int, level int) error {
+	if c.sim {
+		pull := "pull-down"
+		if level != 0 {
+			pull = "pull-up"
+		}
+		return writeFile(c.linePath(offset, "pull"), pull)
+	}
+	return writeFile(c.linePath(offset, ""), strconv.Itoa(level))
+}
+
+// ReadOutput returns the level of a line, the one driven by the chip for an output line.
+func (c *Chip) ReadOutput(offset int) (int, error) {
+	value, err := readFile(c.linePath(offset, "value"))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// linePath returns the path of the attribute of a line.
+// gpio-mockup lines have only one attribute, the file named after their offset.
+func (c *Chip) linePath(offset int, attr string) string {
+	if c.sim {
+		return filepath.Join(c.lines, fmt.Sprintf("sim_gpio%d", offset), attr)
+	}
+	return filepath.Join(c.lines, strconv.Itoa(offset))
+}
+
+// writeFile writes a value to a configfs, sysfs or debugfs attribute.
+func writeFile(path string, value string) error {
+	return ioutil.WriteFile(path, []byte(value), 0644)
+}
+
+// readFile reads the value of a configfs, sysfs or debugfs attribute.
+func readFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package gpiosim_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gpio "github.com/vinymeuh/chardevgpio"
+	"github.com/vinymeuh/chardevgpio/gpiosim"
+)
+
+func newSim(t *testing.T, banks ...gpiosim.Bank) *gpiosim.Sim {
+	if _, err := os.Stat(gpiosim.ConfigfsRoot); err != nil {
+		t.Skipf("gpio-sim not available: %s", err)
+	}
+	sim, err := gpiosim.New("chardevgpio-test", banks...)
+	require.NoError(t, err, "unable to create gpio-sim device")
+	return sim
+}
+
+func TestSim(t *testing.T) {
+	sim := newSim(t,
+		gpiosim.Bank{
+			Label: "sim-A",
+			Lines: 8,
+			Names: map[int]string{0: "LED", 3: "BUTTON"},
+			Hogs:  map[int]gpiosim.Hog{7: {Consumer: "hogger", Direction: gpiosim.HogOutputHigh}},
+		},
+		gpiosim.Bank{Label: "sim-B", Lines: 4},
+	)
+	defer sim.Close()
+
+	chips := sim.Chips()
+	require.Len(t, chips, 2)
+	assert.Equal(t, "sim-A", chips[0].Label)
+	assert.Equal(t, 8, chips[0].Lines)
+	assert.Equal(t, "sim-B", chips[1].Label)
+	assert.Equal(t, 4, chips[1].Lines)
+
+	chip, err := gpio.NewChip(chips[0].Path)
+	require.NoError(t, err)
+	defer chip.Close()
+
+	li, err := chip.LineInfo(3)
+	require.NoError(t, err)
+	assert.Equal(t, "BUTTON", li.Name())
+
+	li, err = chip.LineInfo(7)
+	require.NoError(t, err)
+	assert.True(t, li.IsKernel())
+	assert.True(t, li.IsOutput())
+	assert.Equal(t, "hogger", li.Consumer())
+	value, err := chips[0].ReadOutput(7)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, value)
+}
+
+func TestSimPullAndOutput(t *testing.T) {
+	sim := newSim(t, gpiosim.Bank{Lines: 4})
+	defer sim.Close()
+	simChip := sim.Chips()[0]
+
+	chip, err := gpio.NewChip(simChip.Path)
+	require.NoError(t, err)
+	defer chip.Close()
+
+	in := gpio.NewHandleRequest([]int{0}, gpio.HandleRequestInput)
+	require.NoError(t, chip.RequestLines(in))
+	defer in.Close()
+
+	for _, level := range []int{1, 0} {
+		assert.NoError(t, simChip.SetPull(0, level))
+		value, _, err := in.Read()
+		assert.NoError(t, err)
+		assert.Equal(t, level, value)
+	}
+
+	out := gpio.NewHandleRequest([]int{1}, gpio.HandleRequestOutput)
+	require.NoError(t, chip.RequestLines(out))
+	defer out.Close()
+
+	for _, level := range []int{1, 0} {
+		assert.NoError(t, out.Write(level))
+		value, err := simChip.ReadOutput(1)
+		assert.NoError(t, err)
+		assert.Equal(t, level, value)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+// Package fdfile provides the file descriptors of the GPIO devices, shared by the backends of chardevgpio.
+package fdfile
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// File owns the file descriptor of a chip, of requested lines or of a sysfs attribute.
+// The descriptor is held by an *os.File, so that the Go runtime tracks its uses
+// and closes it only once no operation is in progress. A File is shared by
+// all the copies of the value holding it, closing it is idempotent and using
+// it once closed returns os.ErrClosed.
+type File struct {
+	f  *os.File
+	rc syscall.RawConn
+	fd int // only valid while not closed
+
+	// ioctl arguments and result, so that sending an ioctl does not allocate
+	mu      sync.Mutex
+	req     uintptr
+	arg     unsafe.Pointer
+	errno   syscall.Errno
+	ioctlFn func(fd uintptr)
+
+	// read buffer and result, so that reading does not allocate
+	readMu  sync.Mutex
+	buf     []byte
+	n       int
+	readErr error
+	readFn  func(fd uintptr)
+}
+
+// Open opens the file at path with flag, os.O_RDONLY or os.O_RDWR.
+func Open(path string, flag int) (*File, error) {
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	return newFile(f)
+}
+
+// New takes ownership of a file descriptor returned by the kernel.
+func New(fd int, name string) (*File, error) {
+	return newFile(os.NewFile(uintptr(fd), name))
+}
+
+func newFile(f *os.File) (*File, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	ff := &File{f: f, rc: rc}
+	rc.Control(func(fd uintptr) {
+		ff.fd = int(fd)
+	})
+	ff.ioctlFn = func(fd uintptr) {
+		_, _, ff.errno = unix.Syscall(unix.SYS_IOCTL, fd, ff.req, uintptr(ff.arg))
+	}
+	ff.readFn = func(fd uintptr) {
+		ff.n, ff.readErr = unix.Read(int(fd), ff.buf)
+	}
+	return ff, nil
+}
+
+// Fd returns the file descriptor, only valid while the File is not closed.
+func (ff *File) Fd() int {
+	return ff.fd
+}
+
+// Control runs fn with the file descriptor, which is guaranteed to stay open meanwhile.
+func (ff *File) Control(fn func(fd int) error) error {
+	if ff == nil {
+		return os.ErrClosed
+	}
+
+	var err error
+	if cerr := ff.rc.Control(func(fd uintptr) {
+		err = fn(int(fd))
+	}); cerr != nil {
+		return os.ErrClosed // Control only fails once the file is closed
+	}
+	return err
+}
+
+// Ioctl sends the request req with its argument arg to the file descriptor.
+// It does not allocate as long as arg points to memory already allocated on the heap.
+func (ff *File) Ioctl(req uintptr, arg unsafe.Pointer) error {
+	if ff == nil {
+		return os.ErrClosed
+	}
+
+	ff.mu.Lock()
+	ff.req, ff.arg = req, arg
+	err := ff.rc.Control(ff.ioctlFn)
+	errno := ff.errno
+	ff.arg = nil // arg must not be kept alive
+	ff.mu.Unlock()
+
+	if err != nil {
+		return os.ErrClosed // Control only fails once the file is closed
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Read reads from the file descriptor, without waiting if it is nonblocking.
+// It does not allocate.
+func (ff *File) Read(b []byte) (int, error) {
+	if ff == nil {
+		return 0, os.ErrClosed
+	}
+
+	ff.readMu.Lock()
+	ff.buf = b
+	err := ff.rc.Control(ff.readFn)
+	n, readErr := ff.n, ff.readErr
+	ff.buf, ff.readErr = nil, nil
+	ff.readMu.Unlock()
+
+	if err != nil {
+		return 0, os.ErrClosed // Control only fails once the file is closed
+	}
+	return n, readErr
+}
+
+// ReadAt reads from the file descriptor at offset, as sysfs attributes are read.
+func (ff *File) ReadAt(b []byte, offset int64) (int, error) {
+	var n int
+	err := ff.Control(func(fd int) error {
+		var err error
+		n, err = unix.Pread(fd, b, offset)
+		return err
+	})
+	return n, err
+}
+
+// WriteAt writes to the file descriptor at offset, as sysfs attributes are written.
+func (ff *File) WriteAt(b []byte, offset int64) (int, error) {
+	var n int
+	err := ff.Control(func(fd int) error {
+		var err error
+		n, err = unix.Pwrite(fd, b, offset)
+		return err
+	})
+	return n, err
+}
+
+// Close closes the file descriptor, doing nothing if already closed.
+func (ff *File) Close() error {
+	if ff == nil {
+		return nil
+	}
+	if err := ff.f.Close(); err != nil && !errors.Is(err, os.ErrClosed) {
+		return err
+	}
+	return nil
+}
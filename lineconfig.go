@@ -0,0 +1,207 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"errors"
+	"math/bits"
+	"time"
+)
+
+// LineConfig is the configuration of one line of a HandleRequest.
+type LineConfig struct {
+	Flags    HandleRequestFlag // direction, bias, drive and active-low
+	Edges    EventRequestFlags // edge detection, the line must be an input
+	Debounce time.Duration     // debounce period, the line must be an input
+}
+
+// ErrTooManyAttributes is returned when the configurations of the lines of a request
+// need more than the 10 attributes supported by the v2 API.
+var ErrTooManyAttributes = errors.New("too many distinct line configurations")
+
+// WithLineConfig sets the configuration of one line of a prepared HandleRequest,
+// overriding the flags and the debounce period of the request.
+// Lines of one request can then mix inputs and outputs, biases, drives and edge detection.
+// Except when all lines end up with the same flags, it requires the v2 API, otherwise
+// RequestLines returns ErrUnsupportedByKernel.
+func (hr *HandleRequest) WithLineConfig(offset int, config LineConfig) *HandleRequest {
+	if hr.lineConfigs == nil {
+		hr.lineConfigs = make(map[int]LineConfig)
+	}
+	hr.lineConfigs[offset] = config
+	return hr
+}
+
+// LineConfigs returns the configuration of each line of the HandleRequest, in the order of the lines.
+func (hr *HandleRequest) LineConfigs() []LineConfig {
+	configs := make([]LineConfig, hr.lines)
+	for i := range configs {
+		if config, ok := hr.lineConfigs[int(hr.lineOffsets[i])]; ok {
+			configs[i] = config
+			continue
+		}
+		configs[i].Flags = hr.flags
+		if hr.flags&HandleRequestInput == HandleRequestInput {
+			configs[i].Debounce = hr.debounce
+		}
+	}
+	return configs
+}
+
+// uniformConfigs returns true if all the lines share the flags of the request, without edge detection
+// nor debouncing, as required by the v1 API.
+func (hr *HandleRequest) uniformConfigs() bool {
+	for _, config := range hr.LineConfigs() {
+		if config != (LineConfig{Flags: hr.flags}) {
+			return false
+		}
+	}
+	return true
+}
+
+// anyLine returns true if at least one line of the HandleRequest is configured with flag.
+func (hr *HandleRequest) anyLine(flag HandleRequestFlag) bool {
+	if hr.flags&flag == flag {
+		return true
+	}
+	for _, config := range hr.lineConfigs {
+		if config.Flags&flag == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// outputsMask returns the mask of the output lines of the HandleRequest.
+func (hr *HandleRequest) outputsMask() uint64 {
+	if len(hr.lineConfigs) == 0 {
+		return linesMask(hr.lines)
+	}
+	var mask uint64
+	for i, config := range hr.LineConfigs() {
+		if config.Flags&HandleRequestOutput == HandleRequestOutput {
+			mask |= 1 << uint(i)
+		}
+	}
+	return mask
+}
+
+// uniformLineConfigs returns the configurations of n lines all configured with flags,
+// the debounce period being applied to input lines only.
+func uniformLineConfigs(n uint32, flags HandleRequestFlag, debounce time.Duration) []LineConfig {
+	configs := make([]LineConfig, n)
+	for i := range configs {
+		configs[i].Flags = flags
+		if flags&HandleRequestInput == HandleRequestInput {
+			configs[i].Debounce = debounce
+		}
+	}
+	return configs
+}
+
+// configV2 returns the v2 line configuration of lines configured by configs,
+// with values being the default values of the output lines and clock timestamping their edge events.
+// The most common flags are the default ones, others being set by attributes.
+func configV2(configs []LineConfig, values uint64, clock EventClock) (lineConfigV2, error) {
+	var lc lineConfigV2
+	var attrs []lineConfigAttributeV2
+
+	var flags []uint64
+	flagsMasks := make(map[uint64]uint64)
+	for i, config := range configs {
+		f := handleFlagsToV2(config.Flags) | eventFlagsToV2(config.Edges) | clock.flagsV2()
+		if _, ok := flagsMasks[f]; !ok {
+			flags = append(flags, f)
+		}
+		flagsMasks[f] |= 1 << uint(i)
+	}
+	for _, f := range flags {
+		if bits.OnesCount64(flagsMasks[f]) > bits.OnesCount64(flagsMasks[lc.flags]) {
+			lc.flags = f
+		}
+	}
+	for _, f := range flags {
+		if f != lc.flags {
+			attrs = append(attrs, lineConfigAttributeV2{
+				attr: lineAttributeV2{id: lineAttrIDFlags, value: f},
+				mask: flagsMasks[f],
+			})
+		}
+	}
+
+	var outputs uint64
+	for i, config := range configs {
+		if config.Flags&HandleRequestOutput == HandleRequestOutput {
+			outputs |= 1 << uint(i)
+		}
+	}
+	if outputs != 0 {
+		attrs = append(attrs, lineConfigAttributeV2{
+			attr: lineAttributeV2{id: lineAttrIDOutputValues, value: values & outputs},
+			mask: outputs,
+		})
+	}
+
+	var periods []time.Duration
+	periodsMasks := make(map[time.Duration]uint64)
+	for i, config := range configs {
+		if config.Debounce <= 0 {
+			continue
+		}
+		if _, ok := periodsMasks[config.Debounce]; !ok {
+			periods = append(periods, config.Debounce)
+		}
+		periodsMasks[config.Debounce] |= 1 << uint(i)
+	}
+	for _, period := range periods {
+		attrs = append(attrs, lineConfigAttributeV2{
+			attr: debounceAttributeV2(period),
+			mask: periodsMasks[period],
+		})
+	}
+
+	if len(attrs) > lineNumAttrsMaxV2 {
+		return lc, ErrTooManyAttributes
+	}
+	copy(lc.attrs[:], attrs)
+	lc.numAttrs = uint32(len(attrs))
+	return lc, nil
+}
+
+// Fd returns the file descriptor of the lines, which becomes readable when edge events
+// are available on the lines configured for edge detection, -1 if there is none.
+func (hr *HandleRequest) Fd() int {
+	if src, ok := hr.driver.(EventSource); ok {
+		return src.Fd()
+	}
+	return -1
+}
+
+// ReadEvents returns the edge events available on the lines configured for edge detection, without waiting.
+// Lines must have been requested using the v2 API, otherwise ErrUnsupportedByKernel is returned.
+// The returned slice is reused by the next call.
+func (hr *HandleRequest) ReadEvents() ([]Event, error) {
+	if hr.driver == nil {
+		return nil, ErrNotRequested
+	}
+	src, ok := hr.driver.(EventSource)
+	if !ok {
+		return nil, ErrUnsupportedByKernel
+	}
+
+	evds, err := src.ReadEvents()
+	if len(evds) > 0 {
+		consumer := hr.Consumer()
+		for i := range evds {
+			evds[i].Chip = hr.chip
+			evds[i].Consumer = consumer
+		}
+	}
+	if err != nil {
+		return evds, hr.opError(opRead, err)
+	}
+	return evds, nil
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import "errors"
+
+// LineGroup is a set of lines, possibly spanning several chips and more than 64 lines,
+// read and written as one ordered vector of values.
+//
+// Lines are requested through as few HandleRequests as possible, one per chip unless
+// more than 64 lines of a chip are in the group. Writes are atomic per HandleRequest,
+// so per chip, but not across chips.
+type LineGroup struct {
+	flags    HandleRequestFlag
+	consumer string
+	defaults []int
+	chips    []GPIOChip
+	lines    []groupLine // lines in the order of the vector
+	requests []groupRequest
+}
+
+// groupLine is a line of a LineGroup.
+type groupLine struct {
+	chip   int // index in LineGroup.chips
+	offset int
+}
+
+// groupRequest is a HandleRequest of a LineGroup, with the positions of its lines in the vector.
+type groupRequest struct {
+	hr        *HandleRequest
+	positions []int
+}
+
+// NewLineGroup prepares an empty LineGroup, lines being added with Add.
+func NewLineGroup(flags HandleRequestFlag) *LineGroup {
+	return &LineGroup{flags: flags}
+}
+
+// WithConsumer sets the consumer for a prepared LineGroup.
+func (g *LineGroup) WithConsumer(consumer string) *LineGroup {
+	g.consumer = consumer
+	return g
+}
+
+// WithDefaults sets the default values for a prepared LineGroup, in the order of the lines.
+func (g *LineGroup) WithDefaults(defaults []int) *LineGroup {
+	g.defaults = defaults
+	return g
+}
+
+// Add appends lines of a chip to a prepared LineGroup.
+// Chips are identified by their name, lines of a chip can be added in several calls.
+func (g *LineGroup) Add(chip GPIOChip, offsets ...int) *LineGroup {
+	i := 0
+	for ; i < len(g.chips); i++ {
+		if g.chips[i].Name() == chip.Name() {
+			break
+		}
+	}
+	if i == len(g.chips) {
+		g.chips = append(g.chips, chip)
+	}
+
+	for _, offset := range offsets {
+		g.lines = append(g.lines, groupLine{chip: i, offset: offset})
+	}
+	return g
+}
+
+// Lines returns the number of lines of the LineGroup.
+func (g *LineGroup) Lines() int {
+	return len(g.lines)
+}
+
+// Request requests the lines of the LineGroup to their chips.
+// If one of the requests fails, lines already requested are released.
+// A LineGroup is requested once, requesting it again returns ErrAlreadyRequested, even once closed.
+func (g *LineGroup) Request() error {
+	if len(g.requests) > 0 {
+		return ErrAlreadyRequested
+	}
+
+	for i, chip := range g.chips {
+		var offsets, positions []int
+		for p, line := range g.lines {
+			if line.chip == i {
+				offsets = append(offsets, line.offset)
+				positions = append(positions, p)
+			}
+		}
+
+		for start := 0; start < len(offsets); start += handlesMax {
+			end := start + handlesMax
+			if end > len(offsets) {
+				end = len(offsets)
+			}
+
+			gr := groupRequest{positions: positions[start:end]}
+			gr.hr = NewHandleRequest(offsets[start:end], g.flags).
+				WithConsumer(g.consumer).
+				WithDefaults(g.subset(g.defaults, gr.positions))
+			if err := chip.RequestLines(gr.hr); err != nil {
+				g.Close()
+				g.requests = nil
+				return err
+			}
+			g.requests = append(g.requests, gr)
+		}
+	}
+	return nil
+}
+
+// subset returns the values at positions, missing values being zero.
+func (g *LineGroup) subset(values []int, positions []int) []int {
+	out := make([]int, len(positions))
+	for j, p := range positions {
+		if p < len(values) {
+			out[j] = values[p]
+		}
+	}
+	return out
+}
+
+// Read returns values read from the lines of the LineGroup, in the order of the lines.
+// The first return parameter is the first element of the array of values.
+func (g *LineGroup) Read() (int, []int, error) {
+	if len(g.requests) == 0 {
+		return 0, []int{}, ErrNotRequested
+	}
+
+	values := make([]int, len(g.lines))
+	for _, gr := range g.requests {
+		_, valueN, err := gr.hr.Read()
+		if err != nil {
+			return 0, []int{}, err
+		}
+		for j, p := range gr.positions {
+			values[p] = valueN[j]
+		}
+	}
+	return values[0], values, nil
+}
+
+// Write writes values to the lines of the LineGroup, in the order of the lines.
+// As for HandleRequest, excess values are ignored and lines for which no value is supplied are set to zero.
+func (g *LineGroup) Write(value0 int, valueN ...int) error {
+	if len(g.requests) == 0 {
+		return ErrNotRequested
+	}
+
+	values := append([]int{value0}, valueN...)
+	for _, gr := range g.requests {
+		sub := g.subset(values, gr.positions)
+		if err := gr.hr.Write(sub[0], sub[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reconfigure changes the flags and the default values of the lines of the LineGroup, without releasing them.
+func (g *LineGroup) Reconfigure(flags HandleRequestFlag, defaults []int) error {
+	if len(g.requests) == 0 {
+		return ErrNotRequested
+	}
+
+	for _, gr := range g.requests {
+		if err := gr.hr.Reconfigure(flags, g.subset(defaults, gr.positions)); err != nil {
+			return err
+		}
+	}
+	g.flags = flags
+	g.defaults = defaults
+	return nil
+}
+
+// Close releases the lines of the LineGroup, returning the first error encountered.
+// Closing it again does nothing, other operations then return ErrClosed.
+func (g *LineGroup) Close() error {
+	var err error
+	for _, gr := range g.requests {
+		if e := gr.hr.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+var _ LineHandle = (*LineGroup)(nil)
+
+// ErrAlreadyRequested is returned when requesting a LineGroup whose lines have already been requested.
+var ErrAlreadyRequested = errors.New("lines already requested")
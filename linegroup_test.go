@@ -0,0 +1,96 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+)
+
+func TestLineGroup(t *testing.T) {
+	chipA := newFakeChip(t, "fake-A", 100)
+	chipB := newFakeChip(t, "fake-B", 8)
+
+	// 70 lines on chipA, so split in 2 requests, interleaved with lines of chipB
+	var offsetsA []int
+	for i := 0; i < 70; i++ {
+		offsetsA = append(offsetsA, 99-i)
+	}
+	defaults := make([]int, 73)
+	defaults[0], defaults[70], defaults[72] = 1, 1, 1
+	group := gpio.NewLineGroup(gpio.HandleRequestOutput).
+		WithConsumer("panel").
+		WithDefaults(defaults).
+		Add(chipA, offsetsA...).
+		Add(chipB, 5, 3).
+		Add(chipA, 0)
+	assert.Equal(t, 73, group.Lines())
+	require.NoError(t, group.Request(), "unable to request LineGroup")
+	defer group.Close()
+	assert.Equal(t, gpio.ErrAlreadyRequested, group.Request())
+
+	level, _ := chipA.Level(99)
+	assert.Equal(t, 1, level, "default value of first line")
+	level, _ = chipB.Level(5)
+	assert.Equal(t, 1, level, "default value of line on second chip")
+	level, _ = chipA.Level(0)
+	assert.Equal(t, 1, level, "default value of last line")
+	li, _ := chipA.LineInfo(50)
+	assert.Equal(t, "panel", li.Consumer())
+
+	values := make([]int, 73)
+	values[1], values[71] = 1, 1
+	require.NoError(t, group.Write(values[0], values[1:]...), "unable to write LineGroup")
+	level, _ = chipA.Level(99)
+	assert.Equal(t, 0, level)
+	level, _ = chipA.Level(98)
+	assert.Equal(t, 1, level)
+	level, _ = chipB.Level(3)
+	assert.Equal(t, 1, level)
+
+	require.NoError(t, group.Reconfigure(gpio.HandleRequestInput, nil))
+	chipA.SetLevel(0, 1)
+	chipB.SetLevel(5, 1)
+	_, read, err := group.Read()
+	require.NoError(t, err, "unable to read LineGroup")
+	expected := make([]int, 73)
+	expected[70], expected[72] = 1, 1
+	assert.Equal(t, expected, read)
+
+	assert.NoError(t, group.Close())
+	assert.NoError(t, group.Close())
+	_, _, err = group.Read()
+	assert.True(t, errors.Is(err, gpio.ErrClosed))
+}
+
+func TestLineGroupBusy(t *testing.T) {
+	chipA := newFakeChip(t, "fake-A", 8)
+	chipB := newFakeChip(t, "fake-B", 8)
+
+	busy := gpio.NewHandleRequest([]int{2}, gpio.HandleRequestInput)
+	require.NoError(t, chipB.RequestLines(busy))
+	defer busy.Close()
+
+	group := gpio.NewLineGroup(gpio.HandleRequestInput).Add(chipA, 0, 1).Add(chipB, 1, 2)
+	assert.True(t, errors.Is(group.Request(), gpio.ErrLineBusy))
+
+	li, _ := chipA.LineInfo(0)
+	assert.False(t, li.IsKernel(), "lines already requested should be released")
+	_, _, err := group.Read()
+	assert.Equal(t, gpio.ErrNotRequested, err)
+
+	// a failed request can be retried once the line is free
+	require.NoError(t, busy.Close())
+	require.NoError(t, group.Request())
+	li, _ = chipB.LineInfo(2)
+	assert.True(t, li.IsKernel())
+	assert.NoError(t, group.Close())
+}
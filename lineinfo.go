@@ -0,0 +1,192 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"context"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// WatchLineInfo returns informations about the requested line and starts watching them.
+// Changes are then reported to the LineInfoWatchers of the chip.
+// With the v1 API, it requires Linux 5.7 or later, otherwise ErrUnsupportedByKernel is returned.
+func (c Chip) WatchLineInfo(offset int) (LineInfo, error) {
+	li, err := c.watchLineInfo(offset)
+	if err != nil {
+		return LineInfo{}, &OpError{Op: opWatchLineInfo, Chip: c.Name(), Offsets: []int{offset}, Err: err}
+	}
+	return li, nil
+}
+
+// watchLineInfo is the implementation of WatchLineInfo.
+func (c Chip) watchLineInfo(offset int) (LineInfo, error) {
+	if err := checkOffsets([]int{offset}, c.Lines()); err != nil {
+		return LineInfo{}, err
+	}
+	if c.v2 {
+		var li lineInfoV2
+		li.offset = uint32(offset)
+		if err := c.f.Ioctl(ioctlGetLineInfoWatchV2, unsafe.Pointer(&li)); err != nil {
+			return LineInfo{}, err
+		}
+		return lineInfoFromV2(li), nil
+	}
+
+	var li LineInfo
+	li.offset = uint32(offset)
+	if err := c.f.Ioctl(ioctlGetLineInfoWatch, unsafe.Pointer(&li)); err != nil {
+		return li, unsupportedBefore(err, 5, 7)
+	}
+	return li, nil
+}
+
+// UnwatchLineInfo stops watching informations about the requested line.
+func (c Chip) UnwatchLineInfo(offset int) error {
+	o := uint32(offset)
+	if err := c.f.Ioctl(ioctlGetLineInfoUnwatch, unsafe.Pointer(&o)); err != nil {
+		return &OpError{Op: opUnwatchLineInfo, Chip: c.Name(), Offsets: []int{offset}, Err: unsupportedBefore(err, 5, 7)}
+	}
+	return nil
+}
+
+// LineInfoChangeType is the type of a change of the informations of a line.
+type LineInfoChangeType uint32
+
+// Line informations change types.
+const (
+	LineRequested     LineInfoChangeType = lineChangedRequested
+	LineReleased      LineInfoChangeType = lineChangedReleased
+	LineConfigChanged LineInfoChangeType = lineChangedConfig
+)
+
+// String returns the name of the change type.
+func (t LineInfoChangeType) String() string {
+	switch t {
+	case LineRequested:
+		return "REQUESTED"
+	case LineReleased:
+		return "RELEASED"
+	case LineConfigChanged:
+		return "CONFIG_CHANGED"
+	}
+	return "UNKNOWN"
+}
+
+// LineInfoEvent represents a change of the informations of a watched line.
+type LineInfoEvent struct {
+	Timestamp uint64 // nanoseconds, as provided by the kernel
+	Type      LineInfoChangeType
+	Info      LineInfo // informations of the line after the change
+}
+
+// LineInfoWatcher is a receiver of the changes of the informations of the lines watched on a chip.
+// Only one call can wait at a time, the others returning ErrWaitInProgress.
+type LineInfoWatcher struct {
+	poller
+	chip    Chip
+	pending []LineInfoEvent // events read but not yet delivered
+}
+
+// NewLineInfoWatcher initializes a new LineInfoWatcher for the chip.
+// The chip must stay open as long as the LineInfoWatcher is used.
+func NewLineInfoWatcher(chip Chip) (*LineInfoWatcher, error) {
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+
+	iw := &LineInfoWatcher{poller: p, chip: chip}
+	err = chip.f.Control(func(fd int) error {
+		if err := unix.SetNonblock(fd, true); err != nil {
+			return err
+		}
+		return iw.add(fd, unix.EPOLLIN|unix.EPOLLET)
+	})
+	if err != nil {
+		iw.close()
+		return nil, err
+	}
+	return iw, nil
+}
+
+// Close releases resources helded by the LineInfoWatcher. The chip is not closed.
+func (iw *LineInfoWatcher) Close() error {
+	return iw.close()
+}
+
+// Watch starts watching informations about a line of the chip, see Chip.WatchLineInfo.
+func (iw *LineInfoWatcher) Watch(offset int) (LineInfo, error) {
+	return iw.chip.WatchLineInfo(offset)
+}
+
+// Unwatch stops watching informations about a line of the chip.
+func (iw *LineInfoWatcher) Unwatch(offset int) error {
+	return iw.chip.UnwatchLineInfo(offset)
+}
+
+// Stop stops the LineInfoWatcher, waiting calls then return ErrWatcherStopped.
+func (iw *LineInfoWatcher) Stop() error {
+	return iw.stop()
+}
+
+// Wait waits for the next change of the informations of a watched line.
+func (iw *LineInfoWatcher) Wait() (LineInfoEvent, error) {
+	return iw.WaitContext(context.Background())
+}
+
+// WaitContext waits for the next change of the informations of a watched line, or until ctx is done.
+func (iw *LineInfoWatcher) WaitContext(ctx context.Context) (LineInfoEvent, error) {
+	if err := iw.guard.enter(); err != nil {
+		return LineInfoEvent{}, err
+	}
+	defer iw.guard.leave()
+	defer iw.watchContext(ctx)()
+
+	var events [1]unix.EpollEvent
+	for len(iw.pending) == 0 {
+		_, stopped, err := iw.wait(ctx, events[:])
+		if err != nil {
+			return LineInfoEvent{}, err
+		}
+		if stopped {
+			return LineInfoEvent{}, ErrWatcherStopped
+		}
+		if err := iw.readEvents(); err != nil {
+			return LineInfoEvent{}, err
+		}
+	}
+
+	ev := iw.pending[0]
+	iw.pending = iw.pending[1:]
+	return ev, nil
+}
+
+// readEvents retrieves all the line info changes available on the chip.
+// The chip is fully drained when read receives EAGAIN.
+func (iw *LineInfoWatcher) readEvents() error {
+	for {
+		var ev LineInfoEvent
+		var err error
+		if iw.chip.v2 {
+			var lic lineInfoChangedV2
+			_, err = iw.chip.f.Read((*[unsafe.Sizeof(lic)]byte)(unsafe.Pointer(&lic))[:])
+			ev = LineInfoEvent{Timestamp: lic.timestamp, Type: LineInfoChangeType(lic.eventType), Info: lineInfoFromV2(lic.info)}
+		} else {
+			var lic lineInfoChanged
+			_, err = iw.chip.f.Read((*[unsafe.Sizeof(lic)]byte)(unsafe.Pointer(&lic))[:])
+			ev = LineInfoEvent{Timestamp: lic.timestamp, Type: LineInfoChangeType(lic.eventType), Info: lic.info}
+		}
+		if err != nil {
+			if err == unix.EAGAIN {
+				return nil
+			}
+			return err
+		}
+		iw.pending = append(iw.pending, ev)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+)
+
+func TestLineInfoWatcher(t *testing.T) {
+	requireMockup(t)
+	c := newChip(t)
+	watcher, err := gpio.NewLineInfoWatcher(c)
+	assert.NoError(t, err, "unable to create LineInfoWatcher")
+
+	li, err := watcher.Watch(7)
+	if errors.Is(err, gpio.ErrUnsupportedByKernel) {
+		watcher.Close()
+		c.Close()
+		t.Skip("watching line info requires Linux 5.7 or later")
+	}
+	assert.NoError(t, err, "unable to watch line info")
+	assert.Equal(t, 7, li.Offset(), "wrong offset for watched line")
+
+	// another consumer requests then releases the line
+	other := newChip(t)
+	l := gpio.NewHandleRequest([]int{7}, gpio.HandleRequestOutput).WithConsumer("testLineInfoWatcher")
+	assert.NoError(t, other.RequestLines(l), "unable to request line")
+	l.Close()
+	other.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	ev, err := watcher.WaitContext(ctx)
+	assert.NoError(t, err, "unable to wait for line info change")
+	assert.Equal(t, gpio.LineRequested, ev.Type, "wrong type for line info change")
+	assert.Equal(t, 7, ev.Info.Offset(), "wrong offset for line info change")
+	assert.Equal(t, "testLineInfoWatcher", ev.Info.Consumer(), "wrong consumer for line info change")
+	assert.True(t, ev.Info.IsOutput(), "line should be an output line")
+
+	ev, err = watcher.WaitContext(ctx)
+	assert.NoError(t, err, "unable to wait for line info change")
+	assert.Equal(t, gpio.LineReleased, ev.Type, "wrong type for line info change")
+
+	// no more changes once unwatched
+	assert.NoError(t, watcher.Unwatch(7), "unable to unwatch line info")
+	l = gpio.NewHandleRequest([]int{7}, gpio.HandleRequestInput)
+	assert.NoError(t, c.RequestLines(l), "unable to request line")
+	l.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = watcher.WaitContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "no change should be reported for an unwatched line")
+
+	watcher.Close()
+	c.Close()
+}
@@ -0,0 +1,327 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChipOp is the change reported by a ChipEvent.
+type ChipOp int
+
+// Changes reported by a ChipMonitor.
+const (
+	ChipAdded ChipOp = iota + 1
+	ChipRemoved
+)
+
+// String returns the name of the change.
+func (op ChipOp) String() string {
+	switch op {
+	case ChipAdded:
+		return "added"
+	case ChipRemoved:
+		return "removed"
+	}
+	return "unknown"
+}
+
+// ChipEvent reports a GPIO chip appearing or disappearing.
+type ChipEvent struct {
+	Op    ChipOp
+	Path  string // path of the character device
+	Name  string
+	Label string // empty if the chip could not be opened to read it
+}
+
+// Open opens the chip of an event reporting its addition.
+func (e ChipEvent) Open() (Chip, error) {
+	return NewChip(e.Path)
+}
+
+// ChipMonitor reports the GPIO chips appearing and disappearing, as USB expanders do when plugged or unplugged.
+// Character devices are watched in DevRoot using inotify, every entry named gpiochipN being considered a chip.
+//
+// A chip whose device cannot be opened yet, udev not having set its permissions, is reported once it can be.
+// As the number of a chip can change when it reappears, applications should look for it by label.
+// Only one call can wait at a time, the others returning ErrWaitInProgress.
+type ChipMonitor struct {
+	poller
+	fd  int                // inotify instance
+	buf [4096]byte         // inotify events, reused by each read
+	dir string             // DevRoot when the monitor was created
+	evs [4]unix.EpollEvent // ready file descriptors, reused by each wait
+
+	chips   map[string]string   // labels of the chips present, indexed by path
+	waiting map[string]struct{} // chips present but not accessible yet
+	pending []ChipEvent         // events read, delivered from pending[next]
+	next    int
+}
+
+// NewChipMonitor initializes a new ChipMonitor.
+// Chips already present are not reported, applications should call ListChips once the monitor is created.
+func NewChipMonitor() (*ChipMonitor, error) {
+	p, err := newPoller()
+	if err != nil {
+		return nil, err
+	}
+	m := &ChipMonitor{
+		poller:  p,
+		fd:      -1,
+		dir:     DevRoot,
+		chips:   make(map[string]string),
+		waiting: make(map[string]struct{}),
+	}
+
+	m.fd, err = unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+	const mask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+		unix.IN_ATTRIB | unix.IN_DELETE_SELF | unix.IN_ONLYDIR
+	if _, err := unix.InotifyAddWatch(m.fd, m.dir, mask); err != nil {
+		m.Close()
+		return nil, &os.PathError{Op: "watch", Path: m.dir, Err: err}
+	}
+	if err := m.add(m.fd, unix.EPOLLIN); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	// chips present before the watch are known, so that their removal is reported
+	if err := m.scan(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	m.pending = m.pending[:0]
+	return m, nil
+}
+
+// Close releases resources helded by the ChipMonitor.
+func (m *ChipMonitor) Close() error {
+	err := m.close()
+	if m.fd >= 0 {
+		unix.Close(m.fd)
+		m.fd = -1
+	}
+	return err
+}
+
+// Stop stops the ChipMonitor, waiting calls return as soon as the events already read are delivered.
+// Once stopped, RunContext returns nil, Wait and WaitContext return ErrMonitorStopped.
+func (m *ChipMonitor) Stop() error {
+	return m.stop()
+}
+
+// Wait waits for a chip to be added or removed.
+func (m *ChipMonitor) Wait() (ChipEvent, error) {
+	return m.WaitContext(context.Background())
+}
+
+// WaitContext waits for a chip to be added or removed, or until ctx is done.
+func (m *ChipMonitor) WaitContext(ctx context.Context) (ChipEvent, error) {
+	if err := m.guard.enter(); err != nil {
+		return ChipEvent{}, err
+	}
+	defer m.guard.leave()
+	defer m.watchContext(ctx)()
+
+	if err := m.poll(ctx); err != nil {
+		return ChipEvent{}, err
+	}
+	return m.pop(), nil
+}
+
+// ChipEventHandlerFunc is the type of the function called for each event retrieved by RunContext.
+type ChipEventHandlerFunc func(evd ChipEvent)
+
+// RunContext waits for chips to be added or removed and calls handler for each of them,
+// until the ChipMonitor is stopped or ctx is done. In the latter case, the context error is returned.
+func (m *ChipMonitor) RunContext(ctx context.Context, handler ChipEventHandlerFunc) error {
+	if err := m.guard.enter(); err != nil {
+		return err
+	}
+	defer m.guard.leave()
+	defer m.watchContext(ctx)()
+
+	for {
+		if err := m.poll(ctx); err != nil {
+			if err == ErrMonitorStopped {
+				return nil
+			}
+			return err
+		}
+		for m.next < len(m.pending) {
+			handler(m.pop())
+		}
+	}
+}
+
+// pop returns the next pending event.
+func (m *ChipMonitor) pop() ChipEvent {
+	evd := m.pending[m.next]
+	m.next++
+	return evd
+}
+
+// poll waits until there are pending events, the ChipMonitor is stopped or ctx is done.
+func (m *ChipMonitor) poll(ctx context.Context) error {
+	if m.next == len(m.pending) {
+		m.pending = m.pending[:0]
+		m.next = 0
+	}
+	for len(m.pending) == 0 {
+		nevents, stopped, err := m.wait(ctx, m.evs[:])
+		if err != nil {
+			return err
+		}
+		if nevents > 0 {
+			if err := m.readEvents(); err != nil {
+				return err
+			}
+		}
+		if stopped && len(m.pending) == 0 {
+			return ErrMonitorStopped
+		}
+	}
+	return nil
+}
+
+// readEvents reads the available inotify events and turns the ones about chips into pending events.
+func (m *ChipMonitor) readEvents() error {
+	for {
+		n, err := unix.Read(m.fd, m.buf[:])
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			return nil
+		}
+		if err != nil {
+			return &os.PathError{Op: "read", Path: m.dir, Err: err}
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&m.buf[off]))
+			name := m.buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+
+			switch {
+			case ev.Mask&unix.IN_Q_OVERFLOW != 0:
+				// events were lost, what changed is found by comparing with the chips present
+				if err := m.scan(); err != nil {
+					return err
+				}
+			case ev.Mask&(unix.IN_DELETE_SELF|unix.IN_IGNORED) != 0:
+				return &os.PathError{Op: "watch", Path: m.dir, Err: unix.ENOENT}
+			default:
+				m.handle(ev.Mask, string(bytes.TrimRight(name, "\x00")))
+			}
+		}
+	}
+}
+
+// handle updates the chips present according to an inotify event about an entry of the watched directory.
+func (m *ChipMonitor) handle(mask uint32, name string) {
+	if chipNumber(name) < 0 {
+		return
+	}
+	path := filepath.Join(m.dir, name)
+	switch {
+	case mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+		m.added(path)
+	case mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0:
+		m.removed(path)
+	case mask&unix.IN_ATTRIB != 0:
+		if _, ok := m.waiting[path]; ok {
+			m.added(path) // permissions set by udev
+		}
+	}
+}
+
+// added records a chip present at path and reports it, unless it is already known or not accessible yet.
+func (m *ChipMonitor) added(path string) {
+	if _, ok := m.chips[path]; ok {
+		return
+	}
+	var label string
+	c, err := NewChip(path)
+	switch {
+	case err == nil:
+		label = c.Label()
+		c.Close()
+	case errors.Is(err, ErrPermission):
+		m.waiting[path] = struct{}{}
+		return
+	}
+	delete(m.waiting, path)
+	m.chips[path] = label
+	m.pending = append(m.pending, ChipEvent{Op: ChipAdded, Path: path, Name: filepath.Base(path), Label: label})
+}
+
+// removed forgets a chip and reports it, if it was known.
+func (m *ChipMonitor) removed(path string) {
+	delete(m.waiting, path)
+	label, ok := m.chips[path]
+	if !ok {
+		return
+	}
+	delete(m.chips, path)
+	m.pending = append(m.pending, ChipEvent{Op: ChipRemoved, Path: path, Name: filepath.Base(path), Label: label})
+}
+
+// scan compares the chips present in the watched directory with the known ones and reports the differences.
+func (m *ChipMonitor) scan() error {
+	matches, err := filepath.Glob(filepath.Join(m.dir, chipsPattern))
+	if err != nil {
+		return err
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return chipNumber(matches[i]) < chipNumber(matches[j])
+	})
+
+	present := make(map[string]bool, len(matches))
+	for _, path := range matches {
+		if chipNumber(path) >= 0 {
+			present[path] = true
+		}
+	}
+	var gone []string
+	for path := range m.chips {
+		if !present[path] {
+			gone = append(gone, path)
+		}
+	}
+	sort.Slice(gone, func(i, j int) bool {
+		return chipNumber(gone[i]) < chipNumber(gone[j])
+	})
+	for _, path := range gone {
+		m.removed(path)
+	}
+	for path := range m.waiting {
+		if !present[path] {
+			delete(m.waiting, path)
+		}
+	}
+	for _, path := range matches {
+		if present[path] {
+			m.added(path)
+		}
+	}
+	return nil
+}
+
+// ErrMonitorStopped is returned when waiting for chips on a stopped ChipMonitor.
+var ErrMonitorStopped = errors.New("chip monitor stopped")
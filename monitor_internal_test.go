@@ -0,0 +1,63 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChipMonitorWaitsForPermissions(t *testing.T) {
+	dev, err := ioutil.TempDir("", "dev")
+	require.NoError(t, err)
+	defer os.RemoveAll(dev)
+	DevRoot = dev
+	defer func() { DevRoot = "/dev" }()
+
+	// devices created by the kernel before udev sets their permissions
+	for _, name := range []string{"gpiochip0", "gpiochip1"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dev, name), nil, 0))
+	}
+	m, err := NewChipMonitor()
+	require.NoError(t, err)
+	defer m.Close()
+	if os.Geteuid() == 0 {
+		// root is never denied access, the devices are made waiting as if it had been
+		for _, name := range []string{"gpiochip0", "gpiochip1"} {
+			path := filepath.Join(dev, name)
+			delete(m.chips, path)
+			m.waiting[path] = struct{}{}
+		}
+	}
+	assert.Empty(t, m.chips)
+	assert.Len(t, m.waiting, 2)
+
+	wait := func(timeout time.Duration) (ChipEvent, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return m.WaitContext(ctx)
+	}
+
+	// a device waiting is reported once its permissions are set
+	require.NoError(t, os.Chmod(filepath.Join(dev, "gpiochip0"), 0644))
+	evd, err := wait(time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, ChipEvent{Op: ChipAdded, Path: filepath.Join(dev, "gpiochip0"), Name: "gpiochip0"}, evd)
+	assert.NotContains(t, m.waiting, filepath.Join(dev, "gpiochip0"))
+
+	// a device removed while waiting is not reported
+	require.NoError(t, os.Remove(filepath.Join(dev, "gpiochip1")))
+	_, err = wait(10 * time.Millisecond)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Empty(t, m.waiting)
+}
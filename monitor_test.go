@@ -0,0 +1,162 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+)
+
+// newDevRoot creates a temporary directory standing in for /dev.
+func newDevRoot(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dev")
+	require.NoError(t, err)
+	gpio.DevRoot = dir
+	t.Cleanup(func() {
+		gpio.DevRoot = "/dev"
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func waitChipEvent(t *testing.T, m *gpio.ChipMonitor) gpio.ChipEvent {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	evd, err := m.WaitContext(ctx)
+	require.NoError(t, err)
+	return evd
+}
+
+func TestChipMonitor(t *testing.T) {
+	requireMockup(t)
+	dev := newDevRoot(t)
+	require.NoError(t, os.Symlink(mockChip.Path, filepath.Join(dev, "gpiochip4")))
+
+	m, err := gpio.NewChipMonitor()
+	require.NoError(t, err)
+	defer m.Close()
+
+	// chips present when the monitor is created are not reported, but their removal is
+	require.NoError(t, os.Remove(filepath.Join(dev, "gpiochip4")))
+	evd := waitChipEvent(t, m)
+	assert.Equal(t, gpio.ChipEvent{Op: gpio.ChipRemoved, Path: filepath.Join(dev, "gpiochip4"), Name: "gpiochip4", Label: mockChip.Label}, evd)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dev, "ttyUSB0"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dev, "gpiochip"), nil, 0644))
+	require.NoError(t, os.Symlink(mockChip.Path, filepath.Join(dev, "gpiochip7")))
+	evd = waitChipEvent(t, m)
+	assert.Equal(t, gpio.ChipAdded, evd.Op)
+	assert.Equal(t, "added", evd.Op.String())
+	assert.Equal(t, "gpiochip7", evd.Name)
+	assert.Equal(t, mockChip.Label, evd.Label)
+
+	c, err := evd.Open()
+	require.NoError(t, err)
+	assert.Equal(t, mockChip.Label, c.Label())
+	c.Close()
+
+	// a device which cannot be opened as a chip is reported without label
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dev, "gpiochip8"), nil, 0644))
+	evd = waitChipEvent(t, m)
+	assert.Equal(t, gpio.ChipEvent{Op: gpio.ChipAdded, Path: filepath.Join(dev, "gpiochip8"), Name: "gpiochip8"}, evd)
+
+	require.NoError(t, os.Rename(filepath.Join(dev, "gpiochip7"), filepath.Join(dev, "gpiochip9")))
+	evd = waitChipEvent(t, m)
+	assert.Equal(t, gpio.ChipRemoved, evd.Op)
+	assert.Equal(t, "gpiochip7", evd.Name)
+	assert.Equal(t, mockChip.Label, evd.Label)
+	evd = waitChipEvent(t, m)
+	assert.Equal(t, gpio.ChipAdded, evd.Op)
+	assert.Equal(t, "gpiochip9", evd.Name)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = m.WaitContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "other files are ignored")
+}
+
+func TestChipMonitorDevices(t *testing.T) {
+	dev := newDevRoot(t)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dev, "gpiochip0"), nil, 0644))
+
+	m, err := gpio.NewChipMonitor()
+	require.NoError(t, err)
+	defer m.Close()
+
+	// chips already known are reported once, devices which cannot be opened as chips without label
+	require.NoError(t, os.Chmod(filepath.Join(dev, "gpiochip0"), 0600))
+	require.NoError(t, os.Symlink("/dev/null", filepath.Join(dev, "gpiochip1")))
+	evd := waitChipEvent(t, m)
+	assert.Equal(t, gpio.ChipEvent{Op: gpio.ChipAdded, Path: filepath.Join(dev, "gpiochip1"), Name: "gpiochip1"}, evd)
+	_, err = evd.Open()
+	assert.True(t, errors.Is(err, gpio.ErrNotGPIOChip))
+
+	require.NoError(t, os.Remove(filepath.Join(dev, "gpiochip0")))
+	evd = waitChipEvent(t, m)
+	assert.Equal(t, gpio.ChipEvent{Op: gpio.ChipRemoved, Path: filepath.Join(dev, "gpiochip0"), Name: "gpiochip0"}, evd)
+	assert.Equal(t, "removed", evd.Op.String())
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dev, "gpiochip"), nil, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dev, "gpiochip2.bak"), nil, 0644))
+	require.NoError(t, os.Rename(filepath.Join(dev, "gpiochip1"), filepath.Join(dev, "gpiochip3")))
+	evd = waitChipEvent(t, m)
+	assert.Equal(t, gpio.ChipEvent{Op: gpio.ChipRemoved, Path: filepath.Join(dev, "gpiochip1"), Name: "gpiochip1"}, evd)
+	evd = waitChipEvent(t, m)
+	assert.Equal(t, gpio.ChipEvent{Op: gpio.ChipAdded, Path: filepath.Join(dev, "gpiochip3"), Name: "gpiochip3"}, evd)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = m.WaitContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err, "other files are ignored")
+}
+
+func TestChipMonitorStop(t *testing.T) {
+	dev := newDevRoot(t)
+
+	m, err := gpio.NewChipMonitor()
+	require.NoError(t, err)
+	defer m.Close()
+
+	var events []gpio.ChipEvent
+	done := make(chan error)
+	go func() {
+		done <- m.RunContext(context.Background(), func(evd gpio.ChipEvent) {
+			events = append(events, evd)
+			if len(events) == 2 {
+				m.Stop()
+			}
+		})
+	}()
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dev, "gpiochip0"), nil, 0644))
+	require.NoError(t, os.Remove(filepath.Join(dev, "gpiochip0")))
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("RunContext not stopped")
+	}
+	require.Len(t, events, 2)
+	assert.Equal(t, gpio.ChipAdded, events[0].Op)
+	assert.Equal(t, gpio.ChipRemoved, events[1].Op)
+
+	_, err = m.Wait()
+	assert.Equal(t, gpio.ErrMonitorStopped, err)
+
+	os.RemoveAll(dev)
+	_, err = gpio.NewChipMonitor()
+	assert.True(t, os.IsNotExist(err))
+}
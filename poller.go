@@ -0,0 +1,154 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"context"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// poller waits for file descriptors to become readable using epoll.
+// Waiting calls return when the poller is stopped or when their context is done.
+// Only one call can wait at a time, which waiting calls check with guard.
+type poller struct {
+	epfd   int
+	stopfd int // eventfd signaled by stop
+	wakefd int // eventfd signaled when the context of a waiting call is done
+	guard  waitGuard
+}
+
+// waitGuard rejects a waiting call while another one is in progress, as they would share
+// the events read but not yet delivered.
+type waitGuard struct {
+	busy int32
+}
+
+// enter starts a waiting call, it returns ErrWaitInProgress if another one is in progress.
+func (g *waitGuard) enter() error {
+	if !atomic.CompareAndSwapInt32(&g.busy, 0, 1) {
+		return ErrWaitInProgress
+	}
+	return nil
+}
+
+// leave ends the waiting call started by enter.
+func (g *waitGuard) leave() {
+	atomic.StoreInt32(&g.busy, 0)
+}
+
+// newPoller initializes a new poller.
+func newPoller() (poller, error) {
+	p := poller{epfd: -1, stopfd: -1, wakefd: -1}
+
+	var err error
+	p.epfd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return p, err
+	}
+	for _, fd := range []*int{&p.stopfd, &p.wakefd} {
+		*fd, err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+		if err == nil {
+			err = p.add(*fd, unix.EPOLLIN)
+		}
+		if err != nil {
+			p.close()
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// close releases resources helded by the poller.
+func (p *poller) close() error {
+	err := unix.Close(p.epfd)
+	unix.Close(p.stopfd)
+	unix.Close(p.wakefd)
+	return err
+}
+
+// add adds a file descriptor to watch for the given epoll events.
+func (p *poller) add(fd int, events uint32) error {
+	epEvent := unix.EpollEvent{Events: events, Fd: int32(fd)}
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_ADD, fd, &epEvent)
+}
+
+// remove stops watching a file descriptor.
+func (p *poller) remove(fd int) error {
+	return unix.EpollCtl(p.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+// stop makes pending and future waits return with stopped set.
+func (p *poller) stop() error {
+	return signalEventfd(p.stopfd)
+}
+
+// watchContext wakes up the waiting call when ctx is done.
+// The returned function must be called when the waiting call returns.
+func (p *poller) watchContext(ctx context.Context) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			signalEventfd(p.wakefd)
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// wait waits until file descriptors are ready, the poller is stopped or ctx is done.
+// Ready file descriptors are returned in the n first elements of events.
+// The caller must have called watchContext for ctx to be able to wake up the wait.
+func (p *poller) wait(ctx context.Context, events []unix.EpollEvent) (n int, stopped bool, err error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, false, err
+		}
+
+		nevents, err := unix.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return 0, false, err
+		}
+
+		for i := 0; i < nevents; i++ {
+			switch int(events[i].Fd) {
+			case p.stopfd:
+				stopped = true
+			case p.wakefd:
+				drainEventfd(p.wakefd) // a wake up not followed by a done context comes from a previous call
+			default:
+				events[n] = events[i]
+				n++
+			}
+		}
+		if n > 0 || stopped {
+			return n, stopped, nil
+		}
+	}
+}
+
+// signalEventfd is a helper function to make an eventfd readable.
+func signalEventfd(fd int) error {
+	one := uint64(1)
+	_, err := unix.Write(fd, (*[8]byte)(unsafe.Pointer(&one))[:])
+	return err
+}
+
+// drainEventfd is a helper function to reset the counter of a nonblocking eventfd.
+func drainEventfd(fd int) {
+	var buffer [8]byte
+	unix.Read(fd, buffer[:])
+}
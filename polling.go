@@ -0,0 +1,314 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultPollingInterval is the interval between two samples of the lines of a PollingWatcher when not set.
+const defaultPollingInterval = 10 * time.Millisecond
+
+// PollingWatcher is a receiver of events for a set of lines whose values are sampled at regular intervals,
+// edges being detected by comparing the successive values.
+// It has the same API as LineWatcher and works with the lines of any chip, including chips without
+// interrupt support on which LineWatcher.Add fails.
+//
+// Lines are requested as inputs and sampled by the waiting calls: pulses shorter than the interval are missed,
+// and events are timestamped when detected, so with the precision of the interval.
+// As with LineWatcher, only one call can wait for events at a time, the others returning ErrWaitInProgress.
+type PollingWatcher struct {
+	feed     eventsFeed // first field to be 64 bits aligned for atomic operations
+	interval time.Duration
+	stop     chan struct{} // closed by Stop
+	stopping sync.Once
+	guard    waitGuard
+
+	mu      sync.Mutex // protects lines
+	lines   []*polledLine
+	pending []Event // events detected, delivered from pending[next]
+	next    int
+}
+
+// polledLine is a line added to a PollingWatcher.
+type polledLine struct {
+	chip      string
+	offset    int
+	flags     EventRequestFlags
+	consumer  string
+	clock     EventClock
+	clocked   ClockedChip // chip timestamping the samples, nil to use clock
+	hr        *HandleRequest
+	value     uint64     // last value sampled
+	debouncer *Debouncer // reports the changes of value once settled, at once without debounce period
+	seqno     uint32     // sequence number of the last event
+}
+
+// NewPollingWatcher initializes a new PollingWatcher sampling the lines every interval, 10ms if not positive.
+func NewPollingWatcher(interval time.Duration) (*PollingWatcher, error) {
+	if interval <= 0 {
+		interval = defaultPollingInterval
+	}
+	return &PollingWatcher{interval: interval, stop: make(chan struct{})}, nil
+}
+
+// Close stops the PollingWatcher and releases the lines.
+func (pw *PollingWatcher) Close() error {
+	pw.Stop()
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	var firstErr error
+	for _, pl := range pw.lines {
+		if err := pl.hr.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	pw.lines = nil
+	return firstErr
+}
+
+// Add adds a new line to watch to the PollingWatcher, requesting it as an input.
+// Debouncing is done in software by a Debouncer, a change being reported by the first sample once the line
+// has kept its level for the period. ClockHTE is not supported, the timestamps being taken when sampling,
+// from the clock of the chip if it is a ClockedChip.
+func (pw *PollingWatcher) Add(chip GPIOChip, line int, flags EventRequestFlags, consumer string, options ...WatchOption) error {
+	request := EventRequest{Offset: line, Flags: flags, Consumer: consumer}
+	for _, option := range options {
+		option(&request)
+	}
+	if request.Clock == ClockHTE {
+		return &OpError{Op: opRequestEvents, Chip: chip.Name(), Offsets: []int{line}, Err: ErrUnsupportedByKernel}
+	}
+
+	hr := NewHandleRequest([]int{line}, HandleRequestInput).WithConsumer(consumer)
+	if err := chip.RequestLines(hr); err != nil {
+		return err
+	}
+	value, err := hr.ReadMask()
+	if err != nil {
+		hr.Close()
+		return err
+	}
+
+	pl := &polledLine{
+		chip:      chip.Name(),
+		offset:    line,
+		flags:     flags,
+		consumer:  consumer,
+		clock:     request.Clock,
+		hr:        hr,
+		value:     value,
+		debouncer: NewDebouncer(flags, request.Debounce, int(value)),
+	}
+	pl.clocked, _ = chip.(ClockedChip)
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	pw.lines = append(pw.lines, pl)
+	return nil
+}
+
+// Remove stops watching a line previously added to the PollingWatcher and releases it.
+// Events already detected on the line can still be delivered.
+func (pw *PollingWatcher) Remove(chip GPIOChip, line int) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	for i, pl := range pw.lines {
+		if pl.chip == chip.Name() && pl.offset == line {
+			pw.lines = append(pw.lines[:i], pw.lines[i+1:]...)
+			return pl.hr.Close()
+		}
+	}
+	return ErrLineNotWatched
+}
+
+// Watched returns the lines currently watched by the PollingWatcher, sorted by chip and offset.
+// Pulses missed between two samples cannot be detected, so Lost is always 0.
+func (pw *PollingWatcher) Watched() []WatchedLine {
+	pw.mu.Lock()
+	lines := make([]WatchedLine, 0, len(pw.lines))
+	for _, pl := range pw.lines {
+		lines = append(lines, WatchedLine{Chip: pl.chip, Offset: pl.offset, Flags: pl.flags, Consumer: pl.consumer})
+	}
+	pw.mu.Unlock()
+
+	sort.Slice(lines, func(i, j int) bool {
+		if lines[i].Chip != lines[j].Chip {
+			return lines[i].Chip < lines[j].Chip
+		}
+		return lines[i].Offset < lines[j].Offset
+	})
+	return lines
+}
+
+// Stop stops the PollingWatcher, waiting calls return as soon as the events already detected are delivered.
+// Once stopped, WaitForEver and RunContext return nil, Wait and WaitContext return ErrWatcherStopped.
+func (pw *PollingWatcher) Stop() error {
+	pw.stopping.Do(func() {
+		close(pw.stop)
+	})
+	return nil
+}
+
+// Wait waits for first occurrence of an event on one of the lines.
+func (pw *PollingWatcher) Wait() (Event, error) {
+	return pw.WaitContext(context.Background())
+}
+
+// WaitContext waits for first occurrence of an event on one of the lines, or until ctx is done.
+func (pw *PollingWatcher) WaitContext(ctx context.Context) (Event, error) {
+	if err := pw.guard.enter(); err != nil {
+		return Event{}, err
+	}
+	defer pw.guard.leave()
+
+	if err := pw.poll(ctx); err != nil {
+		return Event{}, err
+	}
+	return pw.pop(), nil
+}
+
+// WaitForEver waits indefinitely for events on the lines, until the PollingWatcher is stopped.
+func (pw *PollingWatcher) WaitForEver(handler EventHandlerFunc) error {
+	return pw.RunContext(context.Background(), handler)
+}
+
+// RunContext waits for events on the lines and calls handler for each of them,
+// until the PollingWatcher is stopped or ctx is done. In the latter case, the context error is returned.
+func (pw *PollingWatcher) RunContext(ctx context.Context, handler EventHandlerFunc) error {
+	if err := pw.guard.enter(); err != nil {
+		return err
+	}
+	defer pw.guard.leave()
+
+	for {
+		if err := pw.poll(ctx); err != nil {
+			if err == ErrWatcherStopped {
+				return nil
+			}
+			return err
+		}
+		for pw.next < len(pw.pending) {
+			handler(pw.pop())
+		}
+	}
+}
+
+// Events returns a channel fed with the events on the lines by an internal goroutine.
+// The channel is closed when the PollingWatcher is stopped or ctx is done, Err then returns the reason.
+// Events dropped because of the overflow policy are counted by Dropped.
+func (pw *PollingWatcher) Events(ctx context.Context, options ...EventsOption) <-chan Event {
+	return pw.feed.run(ctx, pw.RunContext, options)
+}
+
+// Dropped returns the number of events dropped because the channel returned by Events was full.
+func (pw *PollingWatcher) Dropped() uint64 {
+	return pw.feed.droppedEvents()
+}
+
+// Err returns why the channel returned by Events has been closed: nil if the PollingWatcher
+// has been stopped, the context error if the context is done or the error which occurred while sampling.
+func (pw *PollingWatcher) Err() error {
+	return pw.feed.lastErr()
+}
+
+// pop returns the next pending event.
+func (pw *PollingWatcher) pop() Event {
+	evd := pw.pending[pw.next]
+	pw.next++
+	return evd
+}
+
+// poll samples the lines until there are pending events, the PollingWatcher is stopped or ctx is done.
+func (pw *PollingWatcher) poll(ctx context.Context) error {
+	if pw.next == len(pw.pending) {
+		pw.pending = pw.pending[:0]
+		pw.next = 0
+	}
+
+	var timer *time.Timer
+	for len(pw.pending) == 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		select {
+		case <-pw.stop:
+			return ErrWatcherStopped
+		default:
+		}
+
+		if err := pw.sample(); err != nil {
+			return err
+		}
+		if len(pw.pending) > 0 {
+			break
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(pw.interval)
+			defer timer.Stop()
+		} else {
+			timer.Reset(pw.interval)
+		}
+		select {
+		case <-timer.C:
+		case <-pw.stop:
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
+
+// sample reads the values of the lines and appends the events detected to the pending ones.
+func (pw *PollingWatcher) sample() error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	for _, pl := range pw.lines {
+		value, err := pl.hr.ReadMask()
+		if err != nil {
+			return err
+		}
+		now := pl.now()
+		if value != pl.value {
+			pl.value = value
+			if evd, ok := pl.debouncer.Edge(int(value), now); ok {
+				pw.pending = append(pw.pending, pl.event(evd))
+			}
+		}
+		if evd, ok := pl.debouncer.Settle(now); ok {
+			pw.pending = append(pw.pending, pl.event(evd))
+		}
+	}
+	return nil
+}
+
+// now returns the current time in the clock of the events of the line.
+func (pl *polledLine) now() uint64 {
+	if pl.clocked != nil {
+		return pl.clocked.Now(pl.clock)
+	}
+	if pl.clock == ClockRealtime {
+		return uint64(time.Now().UnixNano())
+	}
+	return uint64(monotonicNow())
+}
+
+// event completes an event returned by the debouncer of the line.
+func (pl *polledLine) event(evd Event) Event {
+	pl.seqno++
+	evd.LineSeqno = pl.seqno
+	evd.Clock = pl.clock
+	evd.Chip = pl.chip
+	evd.Offset = pl.offset
+	evd.Consumer = pl.consumer
+	return evd
+}
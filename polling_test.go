@@ -0,0 +1,180 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+)
+
+func TestPollingWatcher(t *testing.T) {
+	chip := newFakeChip(t, "no-irq", 4)
+
+	var watcher gpio.Watcher
+	watcher, err := gpio.NewPollingWatcher(time.Millisecond)
+	require.Nil(t, err)
+	defer watcher.Close()
+
+	chip.SetLevel(2, 1)
+	require.Nil(t, watcher.Add(chip, 1, gpio.RisingEdge, "rising"))
+	require.Nil(t, watcher.Add(chip, 2, gpio.BothEdges, "both", gpio.WithEventClock(gpio.ClockRealtime)))
+	assert.True(t, errors.Is(watcher.Add(chip, 1, gpio.BothEdges, "busy"), gpio.ErrLineBusy))
+	assert.True(t, errors.Is(watcher.Add(chip, 3, gpio.BothEdges, "hte", gpio.WithEventClock(gpio.ClockHTE)), gpio.ErrUnsupportedByKernel))
+	assert.Equal(t, []gpio.WatchedLine{
+		{Chip: chip.Name(), Offset: 1, Flags: gpio.RisingEdge, Consumer: "rising"},
+		{Chip: chip.Name(), Offset: 2, Flags: gpio.BothEdges, Consumer: "both"},
+	}, watcher.Watched())
+	li, _ := chip.LineInfo(2)
+	assert.Equal(t, "both", li.Consumer())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	before := time.Now()
+	chip.SetLevel(2, 0)
+	event, err := watcher.WaitContext(ctx)
+	require.Nil(t, err)
+	assert.True(t, event.IsFalling(), "initial value sampled when added")
+	assert.Equal(t, 2, event.Offset)
+	assert.Equal(t, "both", event.Consumer)
+	assert.Equal(t, uint32(1), event.LineSeqno)
+	assert.Equal(t, gpio.ClockRealtime, event.Clock)
+	assert.WithinDuration(t, before, event.Time(), time.Second)
+
+	chip.SetLevel(1, 1)
+	event, err = watcher.WaitContext(ctx)
+	require.Nil(t, err)
+	assert.True(t, event.IsRising())
+	assert.Equal(t, 1, event.Offset)
+	assert.Equal(t, gpio.ClockMonotonic, event.Clock)
+	assert.True(t, event.Since() < time.Second)
+
+	chip.SetLevel(1, 0) // falling edge not requested
+	short, cancelShort := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelShort()
+	_, err = watcher.WaitContext(short)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	require.Nil(t, watcher.Remove(chip, 1))
+	assert.Equal(t, gpio.ErrLineNotWatched, watcher.Remove(chip, 1))
+	li, _ = chip.LineInfo(1)
+	assert.False(t, li.IsKernel(), "line released")
+
+	events := watcher.Events(ctx)
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	require.Eventually(t, func() bool {
+		_, err := watcher.WaitContext(canceled)
+		return err == gpio.ErrWaitInProgress
+	}, time.Second, time.Millisecond, "waiting while the channel is fed")
+	chip.SetLevel(2, 1)
+	select {
+	case event := <-events:
+		assert.True(t, event.IsRising())
+		assert.Equal(t, uint32(2), event.LineSeqno)
+	case <-ctx.Done():
+		t.Fatal("no event")
+	}
+	require.Nil(t, watcher.Stop())
+	for range events {
+	}
+	assert.Nil(t, watcher.(*gpio.PollingWatcher).Err())
+	_, err = watcher.Wait()
+	assert.Equal(t, gpio.ErrWatcherStopped, err)
+
+	require.Nil(t, watcher.Close())
+	li, _ = chip.LineInfo(2)
+	assert.False(t, li.IsKernel(), "lines released by Close")
+}
+
+func TestPollingWatcherDebounce(t *testing.T) {
+	// the chip clock is advanced by the test, each reading of it while the test waits telling that a sample is being taken
+	var now uint64 = 1000
+	samples := make(chan struct{})
+	chip := newFakeChip(t, "no-irq", 4).WithClock(func() uint64 {
+		select {
+		case samples <- struct{}{}:
+		default:
+		}
+		return atomic.LoadUint64(&now)
+	})
+
+	watcher, err := gpio.NewPollingWatcher(time.Millisecond)
+	require.Nil(t, err)
+	defer watcher.Close()
+	const period = uint64(100 * time.Millisecond)
+	require.Nil(t, watcher.Add(chip, 0, gpio.BothEdges, "debounced", gpio.WithDebounce(time.Duration(period))))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := watcher.Events(ctx)
+	// sampled waits for a sample taken entirely after the changes made by the test, the first one
+	// signaled having possibly read the level before them
+	sampled := func() {
+		for i := 0; i < 2; i++ {
+			select {
+			case <-samples:
+			case <-time.After(time.Second):
+				t.Fatal("line not sampled")
+			}
+		}
+	}
+	// set sets the level of the line and advances the clock by elapsed once sampled
+	set := func(level int, elapsed uint64) {
+		chip.SetLevel(0, level)
+		sampled()
+		atomic.AddUint64(&now, elapsed)
+		sampled()
+	}
+	next := func() gpio.Event {
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+			return gpio.Event{}
+		}
+	}
+	none := func(msg string) {
+		select {
+		case event := <-events:
+			t.Fatalf("%s: %v", msg, event)
+		default:
+		}
+	}
+
+	// the last edge of a bounce is reported once the line has kept its level for the period
+	set(1, 5)
+	set(0, 5)
+	set(1, period-1)
+	none("edge reported before the line is stable")
+	atomic.AddUint64(&now, 1)
+	event := next()
+	assert.True(t, event.IsRising())
+	assert.Equal(t, uint32(1), event.LineSeqno)
+	assert.Equal(t, uint64(1010)+period, event.Timestamp, "end of the period")
+
+	// a glitch is dropped
+	set(0, 5)
+	set(1, 2*period)
+	none("glitch reported")
+
+	// so is a bounce back to the level reported, but not the falling edge once the line is stable
+	set(0, 5)
+	set(1, 5)
+	set(0, period)
+	event = next()
+	assert.True(t, event.IsFalling())
+	assert.Equal(t, uint32(2), event.LineSeqno)
+	none("bounces reported")
+}
@@ -0,0 +1,456 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// LineState is the state of the lines of a SupervisedLines.
+type LineState int
+
+// States of a SupervisedLines.
+const (
+	LinesAcquiring LineState = iota // lines not held, being requested
+	LinesAcquired                   // lines held
+	LinesClosed                     // supervision stopped by Close
+)
+
+// String returns the name of the state.
+func (s LineState) String() string {
+	switch s {
+	case LinesAcquiring:
+		return "acquiring"
+	case LinesAcquired:
+		return "acquired"
+	case LinesClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// StateChange reports a transition of a SupervisedLines.
+type StateChange struct {
+	State   LineState
+	Err     error // failure having caused the lines to be lost, or of the last attempt to acquire them
+	Attempt int   // number of failed attempts since the lines are not held
+}
+
+// StateChangeFunc is the type of the function called for each transition of a SupervisedLines.
+type StateChangeFunc func(change StateChange)
+
+// ChipOpener opens the chip lines are requested from, each time they have to be.
+// The chip is closed once the lines are released.
+type ChipOpener func() (GPIOChip, error)
+
+// ChipByPath returns a ChipOpener opening the chip at path.
+func ChipByPath(path string) ChipOpener {
+	return func() (GPIOChip, error) {
+		return NewChip(path)
+	}
+}
+
+// ChipByLabel returns a ChipOpener opening the first chip whose label matches,
+// which is found again when it reappears with another number.
+func ChipByLabel(label string) ChipOpener {
+	return func() (GPIOChip, error) {
+		return OpenChipByLabel(label)
+	}
+}
+
+// Default backoff between the attempts to acquire the lines of a SupervisedLines.
+const (
+	defaultBackoffMin = 100 * time.Millisecond
+	defaultBackoffMax = 10 * time.Second
+)
+
+// ErrLinesUnavailable is returned by the operations on a SupervisedLines while its lines are not held.
+var ErrLinesUnavailable = errors.New("lines unavailable")
+
+// SupervisedLines holds lines described by a HandleRequest and requests them again when they are lost,
+// like when the device of their chip is removed and comes back.
+//
+// An operation failing because the chip has been removed, ErrChipRemoved, releases the lines and the chip.
+// So do the EIO and ESHUTDOWN errors, with which the drivers of devices going away, like USB expanders,
+// fail before the device is removed. Other errors are returned without releasing them.
+// They are then acquired again in background, the chip being reopened, with an exponential backoff between attempts.
+// Meanwhile operations return ErrLinesUnavailable.
+type SupervisedLines struct {
+	open       ChipOpener
+	request    *HandleRequest // parameters of the lines, never requested itself
+	events     EventRequestFlags
+	watchOpts  []WatchOption
+	onEvent    EventHandlerFunc
+	backoffMin time.Duration
+	backoffMax time.Duration
+	onChange   StateChangeFunc
+
+	mu       sync.Mutex
+	state    LineState
+	chip     GPIOChip
+	lines    *HandleRequest // lines held, nil if none
+	watcher  *LineWatcher   // event lines held, nil if none
+	failure  error          // failure of an operation on the lines held, not yet released
+	values   uint64         // last values written, restored when the lines are requested again
+	written  uint64         // mask of the lines written
+	changed  chan struct{}  // closed and replaced on each transition
+	lost     chan error     // failures detected by the operations
+	cancel   context.CancelFunc
+	done     chan struct{}
+	starting sync.Once
+}
+
+// NewSupervisedLines prepares the supervision of the lines described by request, requested on the chip returned by open.
+// The request is kept as the description of the lines, its offsets, flags, consumer, default values
+// and configurations being applied each time the lines are requested.
+func NewSupervisedLines(open ChipOpener, request *HandleRequest) *SupervisedLines {
+	return &SupervisedLines{
+		open:       open,
+		request:    request.clone(),
+		backoffMin: defaultBackoffMin,
+		backoffMax: defaultBackoffMax,
+		changed:    make(chan struct{}),
+		lost:       make(chan error, 1),
+		done:       make(chan struct{}),
+	}
+}
+
+// WithEvents requests the lines for edge detection rather than for values, each event being passed to handler.
+// Losing one of the lines makes all of them to be requested again.
+func (s *SupervisedLines) WithEvents(flags EventRequestFlags, handler EventHandlerFunc, options ...WatchOption) *SupervisedLines {
+	if handler == nil {
+		handler = func(Event) {}
+	}
+	s.events = flags
+	s.onEvent = handler
+	s.watchOpts = options
+	return s
+}
+
+// WithBackoff sets the delay before the first attempt to acquire lost lines, doubled after each failed attempt up to max.
+func (s *SupervisedLines) WithBackoff(min, max time.Duration) *SupervisedLines {
+	s.backoffMin = min
+	s.backoffMax = max
+	return s
+}
+
+// OnStateChange sets the function called for each transition, and for each failed attempt to acquire the lines.
+// It is called from the goroutine supervising the lines, the operations on the lines failing in the meantime.
+func (s *SupervisedLines) OnStateChange(fn StateChangeFunc) *SupervisedLines {
+	s.onChange = fn
+	return s
+}
+
+// Start starts the supervision, the lines being requested in background.
+// Calling it again does nothing.
+func (s *SupervisedLines) Start() {
+	s.starting.Do(func() {
+		var ctx context.Context
+		ctx, s.cancel = context.WithCancel(context.Background())
+		go s.supervise(ctx)
+	})
+}
+
+// Close stops the supervision and releases the lines.
+func (s *SupervisedLines) Close() error {
+	s.Start() // so that done is closed
+	s.cancel()
+	<-s.done
+	return nil
+}
+
+// State returns the current state of the lines.
+func (s *SupervisedLines) State() LineState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// WaitAcquired waits until the lines are held, the supervision is closed or ctx is done.
+func (s *SupervisedLines) WaitAcquired(ctx context.Context) error {
+	for {
+		s.mu.Lock()
+		state, changed := s.state, s.changed
+		s.mu.Unlock()
+
+		switch state {
+		case LinesAcquired:
+			return nil
+		case LinesClosed:
+			return ErrClosed
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Read reads the values of the lines, see HandleRequest.Read.
+func (s *SupervisedLines) Read() (int, []int, error) {
+	var value0 int
+	var valueN []int
+	err := s.do(func(hr *HandleRequest) (err error) {
+		value0, valueN, err = hr.Read()
+		return err
+	})
+	return value0, valueN, err
+}
+
+// ReadMask reads the values of the lines as a bitmap, see HandleRequest.ReadMask.
+func (s *SupervisedLines) ReadMask() (uint64, error) {
+	var bits uint64
+	err := s.do(func(hr *HandleRequest) (err error) {
+		bits, err = hr.ReadMask()
+		return err
+	})
+	return bits, err
+}
+
+// Write writes the values of the lines, see HandleRequest.Write.
+// Values written are restored when the lines are requested again.
+func (s *SupervisedLines) Write(value0 int, valueN ...int) error {
+	return s.WriteMask(s.request.valuesBits(value0, valueN), linesMask(s.request.lines))
+}
+
+// WriteMask writes the values of the lines whose bit is set in mask, see HandleRequest.WriteMask.
+func (s *SupervisedLines) WriteMask(values, mask uint64) error {
+	return s.do(func(hr *HandleRequest) error {
+		if err := hr.WriteMask(values, mask); err != nil {
+			return err
+		}
+		mask &= hr.outputsMask()
+		s.values = s.values&^mask | values&mask
+		s.written |= mask
+		return nil
+	})
+}
+
+// SetValue writes the value of one line, see HandleRequest.SetValue.
+func (s *SupervisedLines) SetValue(offset int, value int) error {
+	return s.SetValues(map[int]int{offset: value})
+}
+
+// SetValues writes the values of some lines, see HandleRequest.SetValues.
+func (s *SupervisedLines) SetValues(values map[int]int) error {
+	bits, mask, err := s.request.offsetsBits(values)
+	if err != nil {
+		return err
+	}
+	return s.WriteMask(bits, mask)
+}
+
+// Reconfigure changes the flags and the default values of the lines, see HandleRequest.Reconfigure.
+// They are remembered to request the lines again.
+func (s *SupervisedLines) Reconfigure(flags HandleRequestFlag, defaults []int) error {
+	return s.do(func(hr *HandleRequest) error {
+		if err := hr.Reconfigure(flags, defaults); err != nil {
+			return err
+		}
+		// the template is updated in place, the offsets being read without lock
+		s.request.flags = hr.flags
+		s.request.lineConfigs = nil
+		s.request.defaultValues = hr.defaultValues
+		s.written = 0
+		return nil
+	})
+}
+
+// do calls op with the lines held, reporting them lost if it fails because the chip is gone.
+func (s *SupervisedLines) do(op func(hr *HandleRequest) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == LinesClosed {
+		return ErrClosed
+	}
+	if s.events != 0 {
+		return ErrOperationNotPermitted
+	}
+	if s.lines == nil || s.failure != nil {
+		return ErrLinesUnavailable
+	}
+	err := op(s.lines)
+	if linesLost(err) {
+		s.failure = err
+		s.lost <- err // the lines held fail once, so there is room
+	}
+	return err
+}
+
+// linesLost tells if an operation failing with err has lost the lines, their chip being removed or going away.
+func linesLost(err error) bool {
+	return errors.Is(err, ErrChipRemoved) || errors.Is(err, unix.EIO) || errors.Is(err, unix.ESHUTDOWN)
+}
+
+// supervise acquires the lines and acquires them again each time they are lost, until ctx is done.
+func (s *SupervisedLines) supervise(ctx context.Context) {
+	defer close(s.done)
+
+	for {
+		if !s.acquire(ctx) {
+			break
+		}
+		err := s.hold(ctx)
+		s.release()
+		if ctx.Err() != nil {
+			break
+		}
+		s.transition(StateChange{State: LinesAcquiring, Err: err})
+	}
+	s.transition(StateChange{State: LinesClosed})
+}
+
+// acquire requests the lines until they are held, waiting between attempts. It returns false if ctx is done.
+func (s *SupervisedLines) acquire(ctx context.Context) bool {
+	delay := s.backoffMin
+	for attempt := 1; ctx.Err() == nil; attempt++ {
+		err := s.tryAcquire()
+		if err == nil {
+			s.transition(StateChange{State: LinesAcquired})
+			return true
+		}
+		s.transition(StateChange{State: LinesAcquiring, Err: err, Attempt: attempt})
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+		if delay *= 2; delay > s.backoffMax {
+			delay = s.backoffMax
+		}
+	}
+	return false
+}
+
+// tryAcquire opens the chip and requests the lines.
+func (s *SupervisedLines) tryAcquire() error {
+	chip, err := s.open()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.events != 0 {
+		err = s.requestEvents(chip)
+	} else {
+		hr := s.request.clone()
+		for i := uint32(0); i < hr.lines; i++ {
+			if s.written>>i&1 == 1 {
+				hr.defaultValues[i] = uint8(s.values >> i & 1)
+			}
+		}
+		if err = chip.RequestLines(hr); err == nil {
+			s.lines = hr
+		}
+	}
+	if err != nil {
+		chip.Close()
+		return err
+	}
+	s.chip = chip
+	return nil
+}
+
+// requestEvents requests the lines for edge detection.
+// Must be called with s.mu held.
+func (s *SupervisedLines) requestEvents(chip GPIOChip) error {
+	watcher, err := NewLineWatcher()
+	if err != nil {
+		return err
+	}
+	for _, offset := range s.request.Offsets() {
+		if err := watcher.Add(chip, offset, s.events, s.request.Consumer(), s.watchOpts...); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+	s.watcher = watcher
+	return nil
+}
+
+// hold waits until the lines are lost or ctx is done, delivering their events if requested for edge detection.
+func (s *SupervisedLines) hold(ctx context.Context) error {
+	s.mu.Lock()
+	watcher := s.watcher
+	s.mu.Unlock()
+
+	if watcher != nil {
+		return watcher.RunContext(ctx, s.onEvent)
+	}
+	select {
+	case err := <-s.lost:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release releases the lines and the chip.
+func (s *SupervisedLines) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lines != nil {
+		s.lines.Close()
+		s.lines = nil
+	}
+	if s.watcher != nil {
+		s.watcher.Close()
+		s.watcher = nil
+	}
+	if s.chip != nil {
+		s.chip.Close()
+		s.chip = nil
+	}
+	s.failure = nil
+	select {
+	case <-s.lost: // failure of an operation while the lines were lost otherwise
+	default:
+	}
+}
+
+// transition records a change of state and reports it, failed attempts being reported without changing the state.
+func (s *SupervisedLines) transition(change StateChange) {
+	s.mu.Lock()
+	if change.State != s.state {
+		s.state = change.State
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+	s.mu.Unlock()
+
+	if s.onChange != nil {
+		s.onChange(change)
+	}
+}
+
+// clone returns a prepared HandleRequest with the same parameters.
+func (hr *HandleRequest) clone() *HandleRequest {
+	c := &HandleRequest{
+		handleRequest: hr.handleRequest,
+		debounce:      hr.debounce,
+		clock:         hr.clock,
+		err:           hr.err,
+	}
+	c.fd = 0
+	if hr.lineConfigs != nil {
+		c.lineConfigs = make(map[int]LineConfig, len(hr.lineConfigs))
+		for offset, config := range hr.lineConfigs {
+			c.lineConfigs[offset] = config
+		}
+	}
+	return c
+}
@@ -0,0 +1,227 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+	"github.com/vinymeuh/chardevgpio/fake"
+)
+
+// hotplug is a fake chip which can be unplugged and plugged again, as an USB expander.
+type hotplug struct {
+	mu   sync.Mutex
+	chip *fake.Chip
+}
+
+func (h *hotplug) open() (gpio.GPIOChip, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.chip == nil {
+		return nil, gpio.ErrChipNotFound
+	}
+	return h.chip, nil
+}
+
+func (h *hotplug) unplug() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.chip.Unplug()
+	h.chip = nil
+}
+
+func (h *hotplug) plug(chip *fake.Chip) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.chip = chip
+}
+
+// stateRecorder records the state changes of a SupervisedLines.
+type stateRecorder chan gpio.StateChange
+
+func (r stateRecorder) record(change gpio.StateChange) {
+	r <- change
+}
+
+// next returns the next state change other than a failed attempt.
+func (r stateRecorder) next(t *testing.T) gpio.StateChange {
+	for {
+		select {
+		case change := <-r:
+			if change.Attempt == 0 {
+				return change
+			}
+			assert.True(t, errors.Is(change.Err, gpio.ErrChipNotFound))
+		case <-time.After(time.Second):
+			t.Fatal("no state change")
+		}
+	}
+}
+
+func TestSupervisedLines(t *testing.T) {
+	h := &hotplug{chip: newFakeChip(t, "usb", 4)}
+	changes := make(stateRecorder, 100)
+	leds := gpio.NewSupervisedLines(h.open, gpio.NewHandleRequest([]int{2, 3}, gpio.HandleRequestOutput).
+		WithConsumer("leds").WithDefaults([]int{1, 0})).
+		WithBackoff(time.Millisecond, 10*time.Millisecond).
+		OnStateChange(changes.record)
+	assert.Equal(t, gpio.ErrLinesUnavailable, leds.Write(1, 1), "not started")
+
+	leds.Start()
+	assert.Equal(t, gpio.StateChange{State: gpio.LinesAcquired}, changes.next(t))
+	assert.Equal(t, gpio.LinesAcquired, leds.State())
+	level, _ := h.chip.Level(2)
+	assert.Equal(t, 1, level)
+	assert.Nil(t, leds.Write(0, 1))
+	assert.Nil(t, leds.SetValue(2, 1))
+	_, _, err := leds.Read()
+	assert.Equal(t, gpio.ErrOperationNotPermitted, err, "errors of the caller do not release the lines")
+
+	h.unplug()
+	assert.True(t, errors.Is(leds.SetValue(2, 0), gpio.ErrChipRemoved))
+	assert.Equal(t, gpio.ErrLinesUnavailable, leds.SetValue(2, 0))
+	change := changes.next(t)
+	assert.Equal(t, gpio.LinesAcquiring, change.State)
+	assert.True(t, errors.Is(change.Err, gpio.ErrChipRemoved))
+
+	chip := newFakeChip(t, "usb", 4)
+	h.plug(chip)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.Nil(t, leds.WaitAcquired(ctx))
+	assert.Equal(t, gpio.LinesAcquired, changes.next(t).State)
+	li, _ := chip.LineInfo(3)
+	assert.Equal(t, "leds", li.Consumer())
+	assert.True(t, li.IsOutput())
+	for offset, expected := range map[int]int{2: 1, 3: 1} {
+		level, _ := chip.Level(offset)
+		assert.Equal(t, expected, level, "last values written restored on line %d", offset)
+	}
+
+	assert.Nil(t, leds.Close())
+	assert.Nil(t, leds.Close())
+	assert.Equal(t, gpio.LinesClosed, changes.next(t).State)
+	assert.Equal(t, gpio.ErrClosed, leds.Write(1))
+	assert.Equal(t, gpio.ErrClosed, leds.WaitAcquired(ctx))
+	li, _ = chip.LineInfo(3)
+	assert.False(t, li.IsKernel(), "lines released")
+}
+
+func TestSupervisedLinesEvents(t *testing.T) {
+	h := &hotplug{chip: newFakeChip(t, "usb", 4)}
+	changes := make(stateRecorder, 100)
+	events := make(chan gpio.Event, 10)
+	button := gpio.NewSupervisedLines(h.open, gpio.NewHandleRequest([]int{1}, gpio.HandleRequestInput).WithConsumer("button")).
+		WithEvents(gpio.RisingEdge, func(evd gpio.Event) { events <- evd }).
+		WithBackoff(time.Millisecond, 10*time.Millisecond).
+		OnStateChange(changes.record)
+	button.Start()
+	defer button.Close()
+
+	assert.Equal(t, gpio.LinesAcquired, changes.next(t).State)
+	_, _, err := button.Read()
+	assert.Equal(t, gpio.ErrOperationNotPermitted, err)
+
+	waitEvent := func() gpio.Event {
+		select {
+		case evd := <-events:
+			return evd
+		case <-time.After(time.Second):
+			t.Fatal("no event")
+		}
+		return gpio.Event{}
+	}
+	h.chip.SetLevel(1, 1)
+	evd := waitEvent()
+	assert.True(t, evd.IsRising())
+	assert.Equal(t, 1, evd.Offset)
+	assert.Equal(t, "button", evd.Consumer)
+
+	h.unplug()
+	change := changes.next(t)
+	assert.Equal(t, gpio.LinesAcquiring, change.State)
+	assert.True(t, errors.Is(change.Err, gpio.ErrChipRemoved))
+
+	chip := newFakeChip(t, "usb", 4)
+	h.plug(chip)
+	assert.Equal(t, gpio.LinesAcquired, changes.next(t).State)
+	chip.SetLevel(1, 1)
+	evd = waitEvent()
+	assert.Equal(t, chip.Name(), evd.Chip)
+}
+
+// faultyChip is a fake chip whose lines fail with errno once requested.
+type faultyChip struct {
+	*fake.Chip
+	errno unix.Errno
+}
+
+func (c faultyChip) RequestLines(request *gpio.HandleRequest) error {
+	if err := c.Chip.RequestLines(request); err != nil {
+		return err
+	}
+	request.SetDriver(c.Name(), faultyLines{c.errno})
+	return nil
+}
+
+// faultyLines is the LineDriver of the lines of a faultyChip.
+type faultyLines struct {
+	errno unix.Errno
+}
+
+func (l faultyLines) GetValues(mask uint64) (uint64, error)                   { return 0, l.errno }
+func (l faultyLines) SetValues(bits, mask uint64) error                       { return l.errno }
+func (l faultyLines) Reconfigure(flags gpio.HandleRequestFlag, _ []int) error { return l.errno }
+func (l faultyLines) Close() error                                            { return nil }
+
+func TestSupervisedLinesKernelErrors(t *testing.T) {
+	supervise := func(errno unix.Errno) (*gpio.SupervisedLines, stateRecorder) {
+		changes := make(stateRecorder, 100)
+		lines := gpio.NewSupervisedLines(func() (gpio.GPIOChip, error) { return faultyChip{newFakeChip(t, "faulty", 4), errno}, nil },
+			gpio.NewHandleRequest([]int{0}, gpio.HandleRequestOutput)).
+			WithBackoff(time.Millisecond, 10*time.Millisecond).
+			OnStateChange(changes.record)
+		lines.Start()
+		assert.Equal(t, gpio.LinesAcquired, changes.next(t).State)
+		return lines, changes
+	}
+
+	// errors not telling that the chip is going away do not make the lines lost
+	lines, changes := supervise(unix.EINVAL)
+	for i := 0; i < 2; i++ {
+		err := lines.Write(1)
+		assert.True(t, errors.Is(err, unix.EINVAL))
+		assert.False(t, errors.Is(err, gpio.ErrLinesUnavailable))
+	}
+	assert.True(t, errors.Is(lines.Reconfigure(gpio.HandleRequestOutput, []int{0}), unix.EINVAL))
+	assert.Equal(t, gpio.LinesAcquired, lines.State())
+	select {
+	case change := <-changes:
+		t.Fatalf("unexpected state change %v", change)
+	case <-time.After(10 * time.Millisecond):
+	}
+	lines.Close()
+
+	// those of a device going away do, the lines being acquired again
+	for _, errno := range []unix.Errno{unix.EIO, unix.ESHUTDOWN} {
+		lines, changes := supervise(errno)
+		assert.True(t, errors.Is(lines.Write(1), errno))
+		change := changes.next(t)
+		assert.Equal(t, gpio.LinesAcquiring, change.State, "%v", errno)
+		assert.True(t, errors.Is(change.Err, errno))
+		assert.Equal(t, gpio.LinesAcquired, changes.next(t).State)
+		lines.Close()
+	}
+}
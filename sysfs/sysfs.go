@@ -0,0 +1,627 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+// Package sysfs provides GPIO chips implementing chardevgpio.GPIOChip through the legacy
+// sysfs interface, for kernels where /sys/class/gpio works but the character device does not.
+//
+// Lines are exported when requested and unexported when released, unless they were already exported.
+// The sysfs interface has no bias, drive nor debounce settings, lines of one request must share
+// their configuration and edge events are detected by polling the value file of the line:
+// an event is generated when the value read differs from the previous one, timestamped when read.
+// Bounces are filtered by a chardevgpio.Debouncer.
+package sysfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gpio "github.com/vinymeuh/chardevgpio"
+	"github.com/vinymeuh/chardevgpio/internal/fdfile"
+	"golang.org/x/sys/unix"
+)
+
+// Root is the directory of the sysfs GPIO interface, holding the gpiochipN entries and the export and unexport files.
+var Root = "/sys/class/gpio"
+
+// ExportTimeout is how long to wait for the files of a line to be usable once exported,
+// udev possibly changing their permissions after the kernel has created them.
+var ExportTimeout = time.Second
+
+// unsupportedFlags are the HandleRequest flags which cannot be set through sysfs.
+const unsupportedFlags = gpio.HandleRequestOpenDrain | gpio.HandleRequestOpenSource |
+	gpio.HandleRequestBiasPullUp | gpio.HandleRequestBiasPullDown | gpio.HandleRequestBiasDisable
+
+// Chip is a GPIO chip accessed through sysfs.
+type Chip struct {
+	name   string
+	label  string
+	base   int
+	ngpio  int
+	mu     sync.Mutex
+	used   map[int]string // consumers of the lines requested through this Chip, by offset
+	closed bool
+}
+
+// Chips returns the names of the chips found in Root, sorted by base.
+func Chips() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(Root, "gpiochip*"))
+	if err != nil {
+		return nil, err
+	}
+
+	bases := make(map[string]int)
+	var names []string
+	for _, match := range matches {
+		base, err := readInt(filepath.Join(match, "base"))
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(match)
+		bases[name] = base
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return bases[names[i]] < bases[names[j]]
+	})
+	return names, nil
+}
+
+// OpenChip opens the chip named name in Root, like gpiochip512.
+// Note that the number of a chip in sysfs is its base, not the number of its character device.
+func OpenChip(name string) (*Chip, error) {
+	dir := filepath.Join(Root, name)
+	c := &Chip{name: name, used: make(map[int]string)}
+	var err error
+	if c.base, err = readInt(filepath.Join(dir, "base")); err != nil {
+		return nil, &gpio.OpError{Op: "open", Chip: dir, Err: err}
+	}
+	if c.ngpio, err = readInt(filepath.Join(dir, "ngpio")); err != nil {
+		return nil, &gpio.OpError{Op: "open", Chip: dir, Err: err}
+	}
+	if c.label, err = readString(filepath.Join(dir, "label")); err != nil {
+		return nil, &gpio.OpError{Op: "open", Chip: dir, Err: err}
+	}
+	return c, nil
+}
+
+// FindGPIO opens the chip holding the line with the global GPIO number and returns it with the offset of the line.
+// chardevgpio.ErrLineNotFound is returned if there is none.
+func FindGPIO(number int) (*Chip, int, error) {
+	names, err := Chips()
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, name := range names {
+		c, err := OpenChip(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if number >= c.base && number < c.base+c.ngpio {
+			return c, number - c.base, nil
+		}
+	}
+	return nil, 0, gpio.ErrLineNotFound
+}
+
+// Name returns the name of the chip in sysfs.
+func (c *Chip) Name() string {
+	return c.name
+}
+
+// Label returns the label of the chip.
+func (c *Chip) Label() string {
+	return c.label
+}
+
+// Lines returns the number of lines of the chip.
+func (c *Chip) Lines() int {
+	return c.ngpio
+}
+
+// Base returns the global GPIO number of the first line of the chip.
+func (c *Chip) Base() int {
+	return c.base
+}
+
+// GPIO returns the global GPIO number of the line at offset.
+func (c *Chip) GPIO(offset int) int {
+	return c.base + offset
+}
+
+// LineInfo returns informations about the requested line.
+// Lines have no name in sysfs, exported lines are reported as used.
+func (c *Chip) LineInfo(offset int) (gpio.LineInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return gpio.LineInfo{}, c.opError("line info", []int{offset}, gpio.ErrClosed)
+	}
+	if offset < 0 || offset >= c.ngpio {
+		return gpio.LineInfo{}, c.opError("line info", []int{offset}, gpio.ErrInvalidOffset)
+	}
+
+	dir := c.lineDir(offset)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return gpio.NewLineInfo(offset, "", "", false, gpio.HandleRequestInput), nil
+	}
+	flags := gpio.HandleRequestInput
+	if direction, err := readString(filepath.Join(dir, "direction")); err == nil && direction == "out" {
+		flags = gpio.HandleRequestOutput
+	}
+	if activeLow, err := readString(filepath.Join(dir, "active_low")); err == nil && activeLow == "1" {
+		flags |= gpio.HandleRequestActiveLow
+	}
+	consumer, ok := c.used[offset]
+	if !ok {
+		consumer = "sysfs"
+	}
+	return gpio.NewLineInfo(offset, "", consumer, true, flags), nil
+}
+
+// RequestLines takes a prepared HandleRequest and returns it ready to work, exporting its lines.
+// The error matches chardevgpio.ErrLineBusy if one of the lines is already requested through this Chip
+// or used by the kernel, and chardevgpio.ErrUnsupportedByKernel if the request needs a setting
+// not available through sysfs.
+func (c *Chip) RequestLines(request *gpio.HandleRequest) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offsets := request.Offsets()
+	if err := c.checkRequest(offsets, request.Err()); err != nil {
+		return c.opError("request lines", offsets, err)
+	}
+	flags := request.Flags()
+	if flags&unsupportedFlags != 0 || request.Debounce() != 0 {
+		return c.opError("request lines", offsets, gpio.ErrUnsupportedByKernel)
+	}
+	for _, config := range request.LineConfigs() {
+		if config != (gpio.LineConfig{Flags: flags}) {
+			return c.opError("request lines", offsets, gpio.ErrUnsupportedByKernel)
+		}
+	}
+
+	sl := &lines{chip: c, offsets: offsets}
+	for _, offset := range offsets {
+		l, err := c.export(offset, os.O_RDWR)
+		if err != nil {
+			sl.release()
+			return c.opError("request lines", offsets, err)
+		}
+		sl.lines = append(sl.lines, l)
+		c.used[offset] = request.Consumer()
+	}
+	if err := sl.configure(flags, request.Defaults()); err != nil {
+		sl.release()
+		return c.opError("request lines", offsets, err)
+	}
+	request.SetDriver(c.name, sl)
+	return nil
+}
+
+// RequestEvents requests a line for edge detection, its events being read from the returned EventSource.
+// Debouncing is done in software, ClockHTE is not supported.
+func (c *Chip) RequestEvents(request gpio.EventRequest) (gpio.EventSource, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offsets := []int{request.Offset}
+	if err := c.checkRequest(offsets, nil); err != nil {
+		return nil, c.opError("request events", offsets, err)
+	}
+	if request.Clock == gpio.ClockHTE {
+		return nil, c.opError("request events", offsets, gpio.ErrUnsupportedByKernel)
+	}
+
+	l, err := c.export(request.Offset, os.O_RDONLY|unix.O_NONBLOCK)
+	if err != nil {
+		return nil, c.opError("request events", offsets, err)
+	}
+	es := &eventSource{line: l, clock: request.Clock}
+	c.used[request.Offset] = request.Consumer
+	if err := es.configure(request.Flags, request.Debounce); err != nil {
+		es.release()
+		return nil, c.opError("request events", offsets, err)
+	}
+	return es, nil
+}
+
+// Close closes the chip, lines already requested remain usable. Closing it again does nothing.
+func (c *Chip) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	return nil
+}
+
+// checkRequest returns the error preventing the lines at offsets to be requested, err being the one
+// found while preparing the request. Must be called with c.mu held.
+func (c *Chip) checkRequest(offsets []int, err error) error {
+	if c.closed {
+		return gpio.ErrClosed
+	}
+	if err != nil {
+		return err
+	}
+	for _, offset := range offsets {
+		if offset < 0 || offset >= c.ngpio {
+			return gpio.ErrInvalidOffset
+		}
+		if _, ok := c.used[offset]; ok {
+			return unix.EBUSY
+		}
+	}
+	return nil
+}
+
+// opError returns the chardevgpio.OpError for an operation on the chip.
+func (c *Chip) opError(op string, offsets []int, err error) error {
+	return &gpio.OpError{Op: op, Chip: c.name, Offsets: offsets, Err: err}
+}
+
+// lineDir returns the directory of the line at offset once exported.
+func (c *Chip) lineDir(offset int) string {
+	return filepath.Join(Root, "gpio"+strconv.Itoa(c.GPIO(offset)))
+}
+
+// line is an exported line.
+type line struct {
+	chip     *Chip
+	offset   int
+	dir      string
+	f        *fdfile.File // value file, opened with the mode given to export
+	exported bool         // true if exported by us, false if it already was
+}
+
+// export exports the line at offset if needed and opens its value file with mode.
+// Must be called with c.mu held.
+func (c *Chip) export(offset int, mode int) (*line, error) {
+	l := &line{chip: c, offset: offset, dir: c.lineDir(offset)}
+	if _, err := os.Stat(l.dir); os.IsNotExist(err) {
+		if err := writeString(filepath.Join(Root, "export"), strconv.Itoa(c.GPIO(offset))+"\n"); err != nil {
+			return nil, err
+		}
+		l.exported = true
+	}
+
+	var err error
+	deadline := time.Now().Add(ExportTimeout)
+	for {
+		l.f, err = fdfile.Open(filepath.Join(l.dir, "value"), mode)
+		if err == nil {
+			return l, nil
+		}
+		if time.Now().After(deadline) {
+			l.unexport()
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// unexport closes the value file of the line and unexports it if it was exported by us.
+func (l *line) unexport() error {
+	l.f.Close()
+	if !l.exported {
+		return nil
+	}
+	return writeString(filepath.Join(Root, "unexport"), strconv.Itoa(l.chip.GPIO(l.offset))+"\n")
+}
+
+// readValue reads the value of the line.
+func (l *line) readValue() (int, error) {
+	var buf [2]byte
+	n, err := l.f.ReadAt(buf[:], 0)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, unix.EIO
+	}
+	return int(buf[0] - '0'), nil
+}
+
+// writeValue writes the value of the line.
+func (l *line) writeValue(value int) error {
+	buf := [1]byte{'0'}
+	if value != 0 {
+		buf[0] = '1'
+	}
+	_, err := l.f.WriteAt(buf[:], 0)
+	return err
+}
+
+// setAttr writes an attribute of the line.
+func (l *line) setAttr(attr string, value string) error {
+	return writeString(filepath.Join(l.dir, attr), value)
+}
+
+// lines is the LineDriver of lines requested on a sysfs Chip.
+type lines struct {
+	chip    *Chip
+	offsets []int
+	lines   []*line
+	mu      sync.Mutex
+	closed  bool
+}
+
+// configure sets the direction and active_low attributes of the lines,
+// output lines being set to their default values without glitch.
+func (sl *lines) configure(flags gpio.HandleRequestFlag, defaults []int) error {
+	activeLow := 0
+	if flags&gpio.HandleRequestActiveLow == gpio.HandleRequestActiveLow {
+		activeLow = 1
+	}
+	for i, l := range sl.lines {
+		if err := l.setAttr("active_low", strconv.Itoa(activeLow)); err != nil {
+			return err
+		}
+		direction := "in"
+		if flags&gpio.HandleRequestOutput == gpio.HandleRequestOutput {
+			// high and low set the raw level, ignoring active_low
+			var value int
+			if i < len(defaults) {
+				value = defaults[i] & 1
+			}
+			direction = "low"
+			if value^activeLow == 1 {
+				direction = "high"
+			}
+		}
+		if err := l.setAttr("direction", direction); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release unexports the lines and makes them available again.
+// Must be called with chip.mu held.
+func (sl *lines) release() error {
+	var err error
+	for _, l := range sl.lines {
+		if e := l.unexport(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for _, offset := range sl.offsets {
+		delete(sl.chip.used, offset)
+	}
+	return err
+}
+
+// GetValues implements chardevgpio.LineDriver.
+func (sl *lines) GetValues(mask uint64) (uint64, error) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if sl.closed {
+		return 0, gpio.ErrClosed
+	}
+	var bits uint64
+	for i, l := range sl.lines {
+		if mask>>uint(i)&1 == 0 {
+			continue
+		}
+		value, err := l.readValue()
+		if err != nil {
+			return 0, err
+		}
+		bits |= uint64(value&1) << uint(i)
+	}
+	return bits, nil
+}
+
+// SetValues implements chardevgpio.LineDriver, lines being written one after the other.
+func (sl *lines) SetValues(bits, mask uint64) error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if sl.closed {
+		return gpio.ErrClosed
+	}
+	for i, l := range sl.lines {
+		if mask>>uint(i)&1 == 0 {
+			continue
+		}
+		if err := l.writeValue(int(bits >> uint(i) & 1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reconfigure implements chardevgpio.LineDriver.
+func (sl *lines) Reconfigure(flags gpio.HandleRequestFlag, defaults []int) error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if sl.closed {
+		return gpio.ErrClosed
+	}
+	if flags&unsupportedFlags != 0 {
+		return gpio.ErrUnsupportedByKernel
+	}
+	return sl.configure(flags, defaults)
+}
+
+// Close implements chardevgpio.LineDriver, unexporting the lines.
+func (sl *lines) Close() error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if sl.closed {
+		return nil
+	}
+	sl.closed = true
+	sl.chip.mu.Lock()
+	defer sl.chip.mu.Unlock()
+	return sl.release()
+}
+
+// eventSource is the EventSource of a line requested for edge detection on a sysfs Chip.
+type eventSource struct {
+	*line
+	clock     gpio.EventClock
+	value     int // last value read
+	debouncer *gpio.Debouncer
+	fd        int    // file descriptor returned by Fd, the one of the debouncer when debouncing
+	events    uint32 // epoll events signaled on fd
+	lineSeqno uint32
+	evds      []gpio.Event
+	mu        sync.Mutex
+	closed    bool
+}
+
+// configure makes the line an input and enables edge detection, the current value being the reference.
+// Both edges are always detected, otherwise the value would not be known to have changed
+// between two edges of the same kind, those not in flags being dropped by the debouncer.
+func (es *eventSource) configure(flags gpio.EventRequestFlags, debounce time.Duration) error {
+	if err := es.setAttr("direction", "in"); err != nil {
+		return err
+	}
+	if err := es.setAttr("edge", "both"); err != nil {
+		return err
+	}
+	var err error
+	if es.value, err = es.readValue(); err != nil {
+		return err
+	}
+	es.debouncer = gpio.NewDebouncer(flags, debounce, es.value)
+	// kernfs notifies the edges with POLLPRI and POLLERR, the value file being always readable
+	es.fd, es.events = es.f.Fd(), unix.EPOLLPRI
+	if debounce > 0 {
+		es.fd, err = es.debouncer.Watch(es.fd, es.events)
+		es.events = unix.EPOLLIN
+	}
+	return err
+}
+
+// release disables edge detection, unexports the line and makes it available again.
+// Must be called with chip.mu held.
+func (es *eventSource) release() error {
+	if es.debouncer != nil {
+		es.debouncer.Close()
+	}
+	es.setAttr("edge", "none")
+	err := es.unexport()
+	delete(es.chip.used, es.offset)
+	return err
+}
+
+// Fd implements chardevgpio.EventSource, the value file signaling the edges detected as priority data.
+func (es *eventSource) Fd() int {
+	return es.fd
+}
+
+// PollEvents implements chardevgpio.PollEventSource.
+func (es *eventSource) PollEvents() uint32 {
+	return es.events
+}
+
+// ReadEvents implements chardevgpio.EventSource.
+// An event is returned if the value of the line changed since the last read,
+// edges not requested and bounces being dropped.
+func (es *eventSource) ReadEvents() ([]gpio.Event, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	es.evds = es.evds[:0]
+	if es.closed {
+		return es.evds, gpio.ErrClosed
+	}
+	value, err := es.readValue()
+	if err != nil {
+		return es.evds, err
+	}
+	now := es.now()
+	if value != es.value {
+		es.value = value
+		es.accept(es.debouncer.Edge(value, now))
+	}
+	es.accept(es.debouncer.Settle(now))
+	return es.evds, nil
+}
+
+// accept appends an event returned by the debouncer to the events read.
+func (es *eventSource) accept(evd gpio.Event, ok bool) {
+	if !ok {
+		return
+	}
+	es.lineSeqno++
+	evd.LineSeqno = es.lineSeqno
+	evd.Clock = es.clock
+	es.evds = append(es.evds, evd)
+}
+
+// now returns the time in nanoseconds of the clock of the events.
+func (es *eventSource) now() uint64 {
+	id := unix.CLOCK_MONOTONIC
+	if es.clock == gpio.ClockRealtime {
+		id = unix.CLOCK_REALTIME
+	}
+	var ts unix.Timespec
+	unix.ClockGettime(int32(id), &ts)
+	return uint64(ts.Nano())
+}
+
+// Close implements chardevgpio.EventSource, unexporting the line.
+func (es *eventSource) Close() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	if es.closed {
+		return nil
+	}
+	es.closed = true
+	es.chip.mu.Lock()
+	defer es.chip.mu.Unlock()
+	return es.release()
+}
+
+// readString reads a sysfs attribute.
+func readString(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// readInt reads a sysfs attribute holding an integer.
+func readInt(path string) (int, error) {
+	s, err := readString(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
+
+// writeString writes a sysfs attribute, which must exist.
+func writeString(path string, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(value)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+var (
+	_ gpio.GPIOChip        = (*Chip)(nil)
+	_ gpio.LineDriver      = (*lines)(nil)
+	_ gpio.EventSource     = (*eventSource)(nil)
+	_ gpio.PollEventSource = (*eventSource)(nil)
+)
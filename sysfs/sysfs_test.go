@@ -0,0 +1,242 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package sysfs_test
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	gpio "github.com/vinymeuh/chardevgpio"
+	"github.com/vinymeuh/chardevgpio/sysfs"
+	"golang.org/x/sys/unix"
+)
+
+// fakeSysfs is a fake /sys/class/gpio tree. export and unexport are FIFOs read by goroutines
+// creating and removing the directories of the lines written to them, as the kernel does.
+type fakeSysfs struct {
+	t    *testing.T
+	root string
+}
+
+func newFakeSysfs(t *testing.T) *fakeSysfs {
+	root, err := ioutil.TempDir("", "sysfs")
+	require.NoError(t, err)
+	fs := &fakeSysfs{t: t, root: root}
+	fs.write("gpiochip496/base", "496")
+	fs.write("gpiochip496/ngpio", "16")
+	fs.write("gpiochip496/label", "expander")
+	fs.write("gpiochip0/base", "0")
+	fs.write("gpiochip0/ngpio", "54")
+	fs.write("gpiochip0/label", "pinctrl-bcm2835")
+
+	export := fs.fifo("export", func(gpio string) {
+		fs.write("gpio"+gpio+"/direction", "in")
+		fs.write("gpio"+gpio+"/active_low", "0")
+		fs.write("gpio"+gpio+"/edge", "none")
+		fs.write("gpio"+gpio+"/value", "0")
+	})
+	unexport := fs.fifo("unexport", func(gpio string) {
+		os.RemoveAll(filepath.Join(fs.root, "gpio"+gpio))
+	})
+
+	sysfs.Root = root
+	t.Cleanup(func() {
+		export.Close()
+		unexport.Close()
+		os.RemoveAll(root)
+		sysfs.Root = "/sys/class/gpio"
+	})
+	return fs
+}
+
+// fifo creates a FIFO and calls fn with each line written to it, until the returned file is closed.
+func (fs *fakeSysfs) fifo(name string, fn func(line string)) *os.File {
+	path := filepath.Join(fs.root, name)
+	require.NoError(fs.t, unix.Mkfifo(path, 0644))
+	f, err := os.OpenFile(path, os.O_RDWR, 0) // not blocking until a writer opens it
+	require.NoError(fs.t, err)
+	go func() {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fn(scanner.Text())
+		}
+	}()
+	return f
+}
+
+func (fs *fakeSysfs) write(name string, value string) {
+	path := filepath.Join(fs.root, name)
+	require.NoError(fs.t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(fs.t, ioutil.WriteFile(path, []byte(value), 0644))
+}
+
+func (fs *fakeSysfs) read(name string) string {
+	b, err := ioutil.ReadFile(filepath.Join(fs.root, name))
+	require.NoError(fs.t, err)
+	return strings.TrimSpace(string(b))
+}
+
+func (fs *fakeSysfs) exists(name string) bool {
+	_, err := os.Stat(filepath.Join(fs.root, name))
+	return err == nil
+}
+
+func TestChips(t *testing.T) {
+	newFakeSysfs(t)
+
+	names, err := sysfs.Chips()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gpiochip0", "gpiochip496"}, names)
+
+	chip, err := sysfs.OpenChip("gpiochip496")
+	require.NoError(t, err)
+	defer chip.Close()
+	assert.Equal(t, "gpiochip496", chip.Name())
+	assert.Equal(t, "expander", chip.Label())
+	assert.Equal(t, 16, chip.Lines())
+	assert.Equal(t, 496, chip.Base())
+	assert.Equal(t, 500, chip.GPIO(4))
+
+	_, err = sysfs.OpenChip("gpiochip1")
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	chip, offset, err := sysfs.FindGPIO(503)
+	require.NoError(t, err)
+	assert.Equal(t, "gpiochip496", chip.Name())
+	assert.Equal(t, 7, offset)
+	chip, offset, err = sysfs.FindGPIO(17)
+	require.NoError(t, err)
+	assert.Equal(t, "gpiochip0", chip.Name())
+	assert.Equal(t, 17, offset)
+	_, _, err = sysfs.FindGPIO(100)
+	assert.True(t, errors.Is(err, gpio.ErrLineNotFound))
+}
+
+func TestRequestLines(t *testing.T) {
+	fs := newFakeSysfs(t)
+	chip, err := sysfs.OpenChip("gpiochip496")
+	require.NoError(t, err)
+	defer chip.Close()
+
+	li, err := chip.LineInfo(1)
+	require.NoError(t, err)
+	assert.False(t, li.IsKernel())
+
+	out := gpio.NewHandleRequest([]int{0, 1}, gpio.HandleRequestOutput|gpio.HandleRequestActiveLow).
+		WithConsumer("leds").WithDefaults([]int{1, 0})
+	require.NoError(t, chip.RequestLines(out))
+	assert.Equal(t, "low", fs.read("gpio496/direction"), "active low line set to 1")
+	assert.Equal(t, "high", fs.read("gpio497/direction"), "active low line set to 0")
+	assert.Equal(t, "1", fs.read("gpio496/active_low"))
+
+	fs.write("gpio497/direction", "out")
+	fs.write("gpio497/active_low", "1")
+	li, err = chip.LineInfo(1)
+	require.NoError(t, err)
+	assert.True(t, li.IsKernel())
+	assert.True(t, li.IsOutput())
+	assert.True(t, li.IsActiveLow())
+	assert.Equal(t, "leds", li.Consumer())
+
+	assert.NoError(t, out.Write(0, 1))
+	assert.Equal(t, "0", fs.read("gpio496/value"))
+	assert.Equal(t, "1", fs.read("gpio497/value"))
+	assert.NoError(t, out.SetValue(0, 1))
+	assert.Equal(t, "1", fs.read("gpio496/value"))
+
+	busy := gpio.NewHandleRequest([]int{1, 2}, gpio.HandleRequestInput)
+	assert.True(t, errors.Is(chip.RequestLines(busy), gpio.ErrLineBusy))
+	pull := gpio.NewHandleRequest([]int{2}, gpio.HandleRequestInput|gpio.HandleRequestBiasPullUp)
+	assert.True(t, errors.Is(chip.RequestLines(pull), gpio.ErrUnsupportedByKernel))
+	invalid := gpio.NewHandleRequest([]int{16}, gpio.HandleRequestInput)
+	assert.True(t, errors.Is(chip.RequestLines(invalid), gpio.ErrInvalidOffset))
+
+	assert.NoError(t, out.Close())
+	assert.NoError(t, out.Close())
+	assert.True(t, errors.Is(out.Write(1), gpio.ErrClosed))
+	assert.Eventually(t, func() bool { return !fs.exists("gpio496") && !fs.exists("gpio497") },
+		time.Second, time.Millisecond, "lines should be unexported")
+}
+
+func TestRequestLinesAlreadyExported(t *testing.T) {
+	fs := newFakeSysfs(t)
+	fs.write("gpio20/direction", "in")
+	fs.write("gpio20/active_low", "0")
+	fs.write("gpio20/value", "1")
+	chip, err := sysfs.OpenChip("gpiochip0")
+	require.NoError(t, err)
+	defer chip.Close()
+
+	li, err := chip.LineInfo(20)
+	require.NoError(t, err)
+	assert.True(t, li.IsKernel())
+	assert.Equal(t, "sysfs", li.Consumer())
+
+	in := gpio.NewHandleRequest([]int{20}, gpio.HandleRequestInput)
+	require.NoError(t, chip.RequestLines(in))
+	value, _, err := in.Read()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, value)
+
+	assert.NoError(t, in.Close())
+	time.Sleep(10 * time.Millisecond)
+	assert.True(t, fs.exists("gpio20"), "line exported by someone else must stay exported")
+}
+
+func TestRequestEvents(t *testing.T) {
+	fs := newFakeSysfs(t)
+	chip, err := sysfs.OpenChip("gpiochip496")
+	require.NoError(t, err)
+	defer chip.Close()
+
+	src, err := chip.RequestEvents(gpio.EventRequest{Offset: 3, Flags: gpio.RisingEdge, Consumer: "button", Clock: gpio.ClockRealtime})
+	require.NoError(t, err)
+	assert.Equal(t, "both", fs.read("gpio499/edge"), "falling edges are needed to detect the next rising one")
+	assert.True(t, src.Fd() >= 0)
+	assert.Equal(t, uint32(unix.EPOLLPRI), src.(gpio.PollEventSource).PollEvents(), "edges signaled as priority data")
+
+	evds, err := src.ReadEvents()
+	assert.NoError(t, err)
+	assert.Len(t, evds, 0, "no change since requested")
+
+	before := time.Now()
+	fs.write("gpio499/value", "1")
+	evds, err = src.ReadEvents()
+	assert.NoError(t, err)
+	require.Len(t, evds, 1)
+	assert.True(t, evds[0].IsRising())
+	assert.Equal(t, uint32(1), evds[0].LineSeqno)
+	assert.Equal(t, gpio.ClockRealtime, evds[0].Clock)
+	assert.WithinDuration(t, before, evds[0].Time(), time.Second)
+
+	fs.write("gpio499/value", "0")
+	evds, err = src.ReadEvents()
+	assert.NoError(t, err)
+	assert.Len(t, evds, 0, "falling edge not requested")
+	fs.write("gpio499/value", "1")
+	evds, err = src.ReadEvents()
+	assert.NoError(t, err)
+	require.Len(t, evds, 1)
+	assert.Equal(t, uint32(2), evds[0].LineSeqno)
+
+	_, err = chip.RequestEvents(gpio.EventRequest{Offset: 3, Flags: gpio.BothEdges})
+	assert.True(t, errors.Is(err, gpio.ErrLineBusy))
+	_, err = chip.RequestEvents(gpio.EventRequest{Offset: 4, Flags: gpio.BothEdges, Clock: gpio.ClockHTE})
+	assert.True(t, errors.Is(err, gpio.ErrUnsupportedByKernel))
+
+	assert.NoError(t, src.Close())
+	assert.NoError(t, src.Close())
+	_, err = src.ReadEvents()
+	assert.True(t, errors.Is(err, gpio.ErrClosed))
+}
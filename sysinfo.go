@@ -0,0 +1,135 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SysfsRoot is the mount point of sysfs, below which the devices of the chips are resolved.
+var SysfsRoot = "/sys"
+
+// ErrNoGlobalNumber is returned when a chip has no global GPIO numbers, the kernel
+// having been built without the legacy sysfs interface.
+var ErrNoGlobalNumber = errors.New("no global GPIO number")
+
+// sysfsDir returns the directory of the chip on the GPIO bus, symbolic links resolved.
+func (c Chip) sysfsDir() (string, error) {
+	return filepath.EvalSymlinks(filepath.Join(SysfsRoot, "bus", "gpio", "devices", c.Name()))
+}
+
+// Device returns the sysfs directory of the device the chip belongs to, like /sys/devices/platform/soc/fe200000.gpio.
+func (c Chip) Device() (string, error) {
+	dir, err := c.sysfsDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(dir), nil
+}
+
+// Driver returns the name of the driver of the device the chip belongs to, like pinctrl-bcm2835.
+func (c Chip) Driver() (string, error) {
+	dev, err := c.Device()
+	if err != nil {
+		return "", err
+	}
+	link, err := os.Readlink(filepath.Join(dev, "driver"))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Base(link), nil
+}
+
+// Base returns the global GPIO number of the first line of the chip, as used by the legacy sysfs interface.
+// ErrNoGlobalNumber is returned if the chip is not exposed by the sysfs interface.
+//
+// The sysfs interface exposes the chips of a device in its gpio directory, named after their base.
+// A device can have several chips, the one having the label and the number of lines of c is returned.
+func (c Chip) Base() (int, error) {
+	dev, err := c.Device()
+	if err != nil {
+		return 0, err
+	}
+	matches, err := filepath.Glob(filepath.Join(dev, "gpio", "gpiochip*"))
+	if err != nil {
+		return 0, err
+	}
+	for _, dir := range matches {
+		label, err := readSysfsAttr(filepath.Join(dir, "label"))
+		if err != nil || label != c.Label() {
+			continue
+		}
+		ngpio, err := readSysfsAttr(filepath.Join(dir, "ngpio"))
+		if err != nil || ngpio != strconv.Itoa(c.Lines()) {
+			continue
+		}
+		base, err := readSysfsAttr(filepath.Join(dir, "base"))
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(base)
+	}
+	return 0, ErrNoGlobalNumber
+}
+
+// GPIO returns the global GPIO number of the line at offset.
+func (c Chip) GPIO(offset int) (int, error) {
+	if err := checkOffsets([]int{offset}, c.Lines()); err != nil {
+		return 0, err
+	}
+	base, err := c.Base()
+	if err != nil {
+		return 0, err
+	}
+	return base + offset, nil
+}
+
+// FindGPIO searches the chip holding the line with the global GPIO number and returns the path of the chip and the offset of the line.
+// Chips which cannot be opened are skipped. ErrLineNotFound is returned if there is none,
+// or the error opening the first chip skipped.
+func FindGPIO(number int) (string, int, error) {
+	paths, err := ListChips()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var firstErr error
+	for _, path := range paths {
+		c, err := NewChip(path)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		base, err := c.Base()
+		c.Close()
+		if err != nil {
+			continue
+		}
+		if number >= base && number < base+c.Lines() {
+			return path, number - base, nil
+		}
+	}
+	if firstErr != nil {
+		return "", 0, firstErr
+	}
+	return "", 0, ErrLineNotFound
+}
+
+// readSysfsAttr reads a sysfs attribute.
+func readSysfsAttr(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
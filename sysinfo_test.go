@@ -0,0 +1,98 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tempSysfs makes SysfsRoot a temporary directory exposing a chip of the gpio-mockup driver, with lines lines
+// numbered from base, next to another bank of the same device. It returns the directory of the device.
+func tempSysfs(t *testing.T, name, label string, lines, base int) string {
+	root, err := ioutil.TempDir("", "sysfs")
+	require.NoError(t, err)
+	SysfsRoot = root
+	t.Cleanup(func() {
+		SysfsRoot = "/sys"
+		os.RemoveAll(root)
+	})
+
+	dev := filepath.Join(root, "devices", "platform", "gpio-mockup")
+	require.NoError(t, os.MkdirAll(filepath.Join(dev, name), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "bus", "gpio", "devices"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join(dev, name), filepath.Join(root, "bus", "gpio", "devices", name)))
+	require.NoError(t, os.Symlink("../../../bus/platform/drivers/gpio-mockup", filepath.Join(dev, "driver")))
+	for b, l := range map[int]string{base - lines: "other-bank", base: label} {
+		dir := filepath.Join(dev, "gpio", fmt.Sprintf("gpiochip%d", b))
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "base"), []byte(fmt.Sprintf("%d\n", b)), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "label"), []byte(l+"\n"), 0644))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ngpio"), []byte(fmt.Sprintf("%d\n", lines)), 0644))
+	}
+	return dev
+}
+
+func TestChipSysfsAttributes(t *testing.T) {
+	dev := tempSysfs(t, "gpiochip0", "gpio-mockup-A", 16, 496)
+	c := Chip{ChipInfo: ChipInfo{name: stringToBytes("gpiochip0"), label: stringToBytes("gpio-mockup-A"), lines: 16}}
+
+	device, err := c.Device()
+	assert.NoError(t, err)
+	assert.Equal(t, dev, device)
+	driver, err := c.Driver()
+	assert.NoError(t, err)
+	assert.Equal(t, "gpio-mockup", driver)
+	base, err := c.Base()
+	assert.NoError(t, err)
+	assert.Equal(t, 496, base)
+	number, err := c.GPIO(3)
+	assert.NoError(t, err)
+	assert.Equal(t, 499, number)
+	_, err = c.GPIO(16)
+	assert.True(t, errors.Is(err, ErrInvalidOffset))
+
+	// a chip with the same label but another number of lines is not the bank of c
+	other := Chip{ChipInfo: ChipInfo{name: stringToBytes("gpiochip0"), label: stringToBytes("gpio-mockup-A"), lines: 8}}
+	_, err = other.Base()
+	assert.Equal(t, ErrNoGlobalNumber, err)
+
+	require.NoError(t, os.RemoveAll(filepath.Join(dev, "gpio")))
+	_, err = c.Base()
+	assert.Equal(t, ErrNoGlobalNumber, err)
+
+	_, err = Chip{ChipInfo: ChipInfo{name: stringToBytes("gpiochip9")}}.Device()
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFindGPIOSkipsChips(t *testing.T) {
+	root, err := ioutil.TempDir("", "dev")
+	require.NoError(t, err)
+	defer os.RemoveAll(root)
+	DevRoot = root
+	defer func() { DevRoot = "/dev" }()
+
+	_, _, err = FindGPIO(499)
+	assert.Equal(t, ErrLineNotFound, err)
+
+	// character devices which are not GPIO chips are skipped, the error opening the first one being returned
+	for _, name := range []string{"gpiochip0", "gpiochip1"} {
+		require.NoError(t, os.Symlink("/dev/null", filepath.Join(root, name)))
+	}
+	_, _, err = FindGPIO(499)
+	assert.True(t, errors.Is(err, ErrNotGPIOChip))
+	var opErr *OpError
+	if assert.True(t, errors.As(err, &opErr)) {
+		assert.Equal(t, filepath.Join(root, "gpiochip0"), opErr.Chip)
+	}
+}
@@ -61,6 +61,21 @@ type LineInfo struct {
 	consumer [32]byte
 }
 
+// Line changed types
+const (
+	lineChangedRequested = 1
+	lineChangedReleased  = 2
+	lineChangedConfig    = 3
+)
+
+// lineInfoChanged is the record read from a chip when the informations of a watched line changed (require Kernel 5.7 or later).
+type lineInfoChanged struct {
+	info      LineInfo
+	timestamp uint64
+	eventType uint32
+	padding   [5]uint32
+}
+
 // handlesMax limits maximum number of handles that can be requested in a GPIOHandleRequest
 const handlesMax = 64
 
@@ -79,9 +94,8 @@ const (
 	HandleRequestBiasDisable                    = 1 << 7
 )
 
-// HandleRequest represents at first a query to be sent to a chip to get control on a set of lines.
-// After be returned by the chip, it must be used to send or received data to lines.
-type HandleRequest struct {
+// handleRequest is the query sent to a chip to get control on a set of lines.
+type handleRequest struct {
 	lineOffsets   [handlesMax]uint32
 	flags         HandleRequestFlag
 	defaultValues [handlesMax]uint8
@@ -90,7 +104,7 @@ type HandleRequest struct {
 	fd            int32 // C int is 32 bits even on x86_64
 }
 
-// HandleConfig is the structure to reconfigure an existing HandleRequest (not used currently, require Kernel 5.5 or later).
+// HandleConfig is the structure to reconfigure an existing HandleRequest (require Kernel 5.5 or later).
 type HandleConfig struct {
 	flags         uint32
 	defaultValues [handlesMax]uint8
@@ -108,6 +122,7 @@ type handleData struct {
 const (
 	ioctlHandleGetLineValues = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x08 << iocNRShift) | (unsafe.Sizeof(handleData{}) << iocSizeShift)
 	ioctlHandleSetLineValues = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x09 << iocNRShift) | (unsafe.Sizeof(handleData{}) << iocSizeShift)
+	ioctlHandleSetConfig     = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x0A << iocNRShift) | (unsafe.Sizeof(HandleConfig{}) << iocSizeShift)
 )
 
 // EventRequestFlags defines the kind of event to wait on a line.
@@ -135,8 +150,9 @@ const (
 	eventFallingEdge = 0x02
 )
 
-// Event represents a occurred event.
-type Event struct {
+// eventData is the record read from an EventLine when an event occurred,
+// decoded in place from the buffer read. Its size depends on the architecture, see eventDataSize.
+type eventData struct {
 	Timestamp uint64
 	ID        uint32
 }
@@ -144,6 +160,125 @@ type Event struct {
 const (
 	ioctlGetChipInfo   = (iocRead << iocDirShift) | (0xB4 << iocTypeShift) | (0x01 << iocNRShift) | (unsafe.Sizeof(ChipInfo{}) << iocSizeShift)
 	ioctlGetLineInfo   = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x02 << iocNRShift) | (unsafe.Sizeof(LineInfo{}) << iocSizeShift)
-	ioctlGetLineHandle = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x03 << iocNRShift) | (unsafe.Sizeof(HandleRequest{}) << iocSizeShift)
+	ioctlGetLineHandle = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x03 << iocNRShift) | (unsafe.Sizeof(handleRequest{}) << iocSizeShift)
 	ioctlGetLineEvent  = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x04 << iocNRShift) | (unsafe.Sizeof(EventLine{}) << iocSizeShift)
+
+	ioctlGetLineInfoWatch   = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x0B << iocNRShift) | (unsafe.Sizeof(LineInfo{}) << iocSizeShift)
+	ioctlGetLineInfoUnwatch = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x0C << iocNRShift) | (unsafe.Sizeof(uint32(0)) << iocSizeShift)
+)
+
+/*
+ * gpio v2 code from uapi/linux/gpio.h
+ * For reference see https://elixir.bootlin.com/linux/v5.10/source/include/uapi/linux/gpio.h
+ *
+ * All 64 bits fields are placed at offsets multiple of 8 so that the Go layout
+ * matches the __aligned_u64 layout of the kernel, even on 32 bits architectures.
+ */
+
+// linesMaxV2 limits maximum number of lines that can be requested in a lineRequestV2
+const linesMaxV2 = 64
+
+// lineNumAttrsMaxV2 limits maximum number of attributes in a lineConfigV2
+const lineNumAttrsMaxV2 = 10
+
+// v2 line flags
+const (
+	lineFlagV2Used          = 1 << 0
+	lineFlagV2ActiveLow     = 1 << 1
+	lineFlagV2Input         = 1 << 2
+	lineFlagV2Output        = 1 << 3
+	lineFlagV2EdgeRising    = 1 << 4
+	lineFlagV2EdgeFalling   = 1 << 5
+	lineFlagV2OpenDrain     = 1 << 6
+	lineFlagV2OpenSource    = 1 << 7
+	lineFlagV2BiasPullUp    = 1 << 8
+	lineFlagV2BiasPullDown  = 1 << 9
+	lineFlagV2BiasDisabled  = 1 << 10
+	lineFlagV2ClockRealtime = 1 << 11
+	lineFlagV2ClockHTE      = 1 << 12
+)
+
+// lineValuesV2 holds values of a set of lines, only lines whose bit is set in mask are concerned.
+type lineValuesV2 struct {
+	bits uint64
+	mask uint64
+}
+
+// v2 line attribute identifiers
+const (
+	lineAttrIDFlags        = 1
+	lineAttrIDOutputValues = 2
+	lineAttrIDDebounce     = 3
+)
+
+// lineAttributeV2 is a configurable attribute of a line.
+// value is the union of flags, values and debounce_period_us of the kernel structure.
+type lineAttributeV2 struct {
+	id      uint32
+	padding uint32
+	value   uint64
+}
+
+// lineConfigAttributeV2 is a configuration attribute associated with one or more lines of a request.
+type lineConfigAttributeV2 struct {
+	attr lineAttributeV2
+	mask uint64
+}
+
+// lineConfigV2 is the configuration of a set of lines.
+type lineConfigV2 struct {
+	flags    uint64
+	numAttrs uint32
+	padding  [5]uint32
+	attrs    [lineNumAttrsMaxV2]lineConfigAttributeV2
+}
+
+// lineRequestV2 is the query sent to a chip to get control on a set of lines.
+type lineRequestV2 struct {
+	offsets         [linesMaxV2]uint32
+	consumer        [32]byte
+	config          lineConfigV2
+	numLines        uint32
+	eventBufferSize uint32
+	padding         [5]uint32
+	fd              int32 // C int is 32 bits even on x86_64
+}
+
+// lineInfoV2 contains informations about a GPIO line.
+type lineInfoV2 struct {
+	name     [32]byte
+	consumer [32]byte
+	offset   uint32
+	numAttrs uint32
+	flags    uint64
+	attrs    [lineNumAttrsMaxV2]lineAttributeV2
+	padding  [4]uint32
+}
+
+// lineInfoChangedV2 is the record read from a chip when the informations of a watched line changed.
+type lineInfoChangedV2 struct {
+	info      lineInfoV2
+	timestamp uint64
+	eventType uint32
+	padding   [5]uint32
+}
+
+// lineEventV2 is the record read from a line request when an edge is detected,
+// decoded in place from the buffer read. Its size is the same on all architectures.
+type lineEventV2 struct {
+	Timestamp uint64
+	ID        uint32
+	Offset    uint32
+	Seqno     uint32
+	LineSeqno uint32
+	Padding   [6]uint32
+}
+
+const (
+	ioctlGetLineInfoV2      = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x05 << iocNRShift) | (unsafe.Sizeof(lineInfoV2{}) << iocSizeShift)
+	ioctlGetLineInfoWatchV2 = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x06 << iocNRShift) | (unsafe.Sizeof(lineInfoV2{}) << iocSizeShift)
+	ioctlGetLineV2          = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x07 << iocNRShift) | (unsafe.Sizeof(lineRequestV2{}) << iocSizeShift)
+	ioctlLineSetConfigV2    = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x0D << iocNRShift) | (unsafe.Sizeof(lineConfigV2{}) << iocSizeShift)
+	ioctlLineGetValuesV2    = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x0E << iocNRShift) | (unsafe.Sizeof(lineValuesV2{}) << iocSizeShift)
+	ioctlLineSetValuesV2    = ((iocRead | iocWrite) << iocDirShift) | (0xB4 << iocTypeShift) | (0x0F << iocNRShift) | (unsafe.Sizeof(lineValuesV2{}) << iocSizeShift)
 )
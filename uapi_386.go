@@ -0,0 +1,10 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux
+
+package chardevgpio
+
+// eventDataSize is the size of the gpioevent_data records read from an EventLine.
+// On i386, 64 bits members are only 4 bytes aligned, so the structure has no trailing padding.
+const eventDataSize = 12
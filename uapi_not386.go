@@ -0,0 +1,11 @@
+// Copyright 2020 VinyMeuh. All rights reserved.
+// Use of the source code is governed by a MIT-style license that can be found in the LICENSE file.
+
+// +build linux,!386
+
+package chardevgpio
+
+// eventDataSize is the size of the gpioevent_data records read from an EventLine.
+// The structure is padded to the 8 bytes alignment of its 64 bits timestamp, including on
+// 32 bits ARM where Go aligns uint64 on 4 bytes, so it is not unsafe.Sizeof(eventData{}).
+const eventDataSize = 16